@@ -1,68 +1,94 @@
 package client
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/RinesThaix/homeTask/connection"
 	"github.com/RinesThaix/homeTask/event"
 	"github.com/RinesThaix/homeTask/server"
 	"github.com/RinesThaix/homeTask/state"
+	"github.com/RinesThaix/homeTask/util"
 	"sync"
 )
 
-type Client struct {
-	Handler *Handler
-	server  *server.Server
-	state   *state.State
+// maxRetries is how many times an operation is resent when its response is lost
+const maxRetries = 3
+
+// ClientOf replicates the document of elements of type T
+type ClientOf[T comparable] struct {
+	Handler *HandlerOf[T]
+	id      string
+	server  *server.ServerOf[T]
+	state   *state.StateOf[T]
 	conn    *connection.ServerConnection
 
 	offlineOperations []state.Operation
+	undoStack         []committedOperation
+	redoStack         []committedOperation
+	transformer       *state.OperationalTransformerOf[T]
+
+	chunkSize    int
+	transfer     *transfer[T]
+	onProgress   func(loaded, total int)
+	transferLock sync.Mutex
+	overflow     state.OverflowPolicy
+	onRejected   func(op state.Operation, err error)
+	onDivergence func(version int, expected, actual uint64)
 
 	clientConn       *connection.ClientConnection
 	version          int
+	operationID      uint64
 	awaitingResponse bool
 	mutex            sync.Mutex
 }
 
+type Client = ClientOf[int32]
+
 func NewClient(server *server.Server) *Client {
-	c := &Client{}
+	return NewClientOf(util.Int32Codec, server)
+}
+
+// NewClientOf creates the client of the server keeping the document of elements of type T, that are compared
+// and hashed with the codec the same way the server does
+func NewClientOf[T comparable](codec util.Codec[T], server *server.ServerOf[T]) *ClientOf[T] {
+	c := &ClientOf[T]{}
+	c.id = newClientID()
 	c.server = server
-	c.Handler = &Handler{client: c}
-	c.state = state.NewState(make([]int32, 0))
+	c.Handler = &HandlerOf[T]{client: c}
+	c.state = state.NewStateWithCodec(codec, util.BackendBlocked, make([]T, 0))
+	c.transformer = &state.OperationalTransformerOf[T]{}
+	c.chunkSize = defaultChunkSize
 	c.conn = &connection.ServerConnection{SendFunc: server.Handler.Handle}
 	return c
 }
 
-func (c *Client) Initialize() error {
+// ID identifies the client as the author of its operations
+func (c *ClientOf[T]) ID() string {
+	return c.id
+}
+
+func (c *ClientOf[T]) Initialize() error {
 	return c.initialize(false)
 }
 
-func (c *Client) initialize(locked bool) error {
-	errors := make(chan error)
-	c.conn.SendWithCallback(&event.ClientInitialize{}, func(rawEvent event.Event, err error) {
-		defer close(errors)
-		if err != nil {
-			errors <- fmt.Errorf("could not initialize client: %w", err)
-			return
-		}
-		casted, ok := rawEvent.(*event.ServerInitializationResponse)
-		if !ok {
-			errors <- fmt.Errorf("received unexpected response to client initialization: %T", rawEvent)
-			return
-		}
-		c.state.Set(casted.Array)
-		c.mutex.Lock()
-		c.version = casted.Version
-		c.mutex.Unlock()
-	})
-	for err := range errors {
-		if err != nil {
-			return err
+func (c *ClientOf[T]) initialize(locked bool) error {
+	version, array, sorted, err := c.download()
+	if err != nil {
+		return fmt.Errorf("could not initialize client: %w", err)
+	}
+	c.state.Set(array)
+	if sorted && !c.state.Sorted() {
+		if err := c.state.EnableSortedMode(); err != nil {
+			return fmt.Errorf("could not initialize client: %w", err)
 		}
 	}
 	if !locked {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
+	c.version = version
 	c.clientConn = &connection.ClientConnection{SendFunc: func(event event.ServerEvent) {
 		if err := c.Handler.Handle(event); err != nil {
 			panic(err)
@@ -73,13 +99,13 @@ func (c *Client) initialize(locked bool) error {
 	return nil
 }
 
-func (c *Client) Disconnect() {
+func (c *ClientOf[T]) Disconnect() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.disconnect()
 }
 
-func (c *Client) disconnect() {
+func (c *ClientOf[T]) disconnect() {
 	if c.clientConn == nil {
 		return
 	}
@@ -87,52 +113,210 @@ func (c *Client) disconnect() {
 	c.version = 0
 	c.awaitingResponse = false
 	c.clientConn = nil
+	c.undoStack, c.redoStack = nil, nil
 }
 
-func (c *Client) reinitialize() error {
+func (c *ClientOf[T]) reinitialize() error {
 	c.disconnect()
 	return c.initialize(true)
 }
 
-func (c *Client) Insert(pos int, value int32) error {
-	return c.modify(&state.OpInsert{Position: pos, Value: value})
+func (c *ClientOf[T]) Insert(pos int, value T) error {
+	return c.modify(&state.OpInsertOf[T]{Position: pos, Value: value})
 }
 
-func (c *Client) Update(pos int, value int32) error {
+// Update replaces the value at pos; in a sorted document the element is moved to where the value belongs
+func (c *ClientOf[T]) Update(pos int, value T) error {
 	previousValue, err := c.state.Get(pos)
 	if err != nil {
 		return err
 	}
-	return c.modify(&state.OpUpdate{Position: pos, Value: value, PreviousValue: previousValue})
+	if c.state.Sorted() {
+		return c.modify(&state.OpUpdateSortedOf[T]{Position: pos, Value: value, PreviousValue: previousValue})
+	}
+	return c.modify(&state.OpUpdateOf[T]{Position: pos, Value: value, PreviousValue: previousValue})
+}
+
+// InsertSorted inserts the value into a sorted document, where the server chooses the position for it
+func (c *ClientOf[T]) InsertSorted(value T) error {
+	if !c.state.Sorted() {
+		return fmt.Errorf("could not insert %v by value: document is not sorted", value)
+	}
+	return c.modify(&state.OpInsertSortedOf[T]{Value: value})
 }
 
-func (c *Client) Delete(pos int) error {
+func (c *ClientOf[T]) Delete(pos int) error {
 	previousValue, err := c.state.Get(pos)
 	if err != nil {
 		return err
 	}
-	return c.modify(&state.OpDelete{Position: pos, PreviousValue: previousValue})
+	return c.modify(&state.OpDeleteOf[T]{Position: pos, PreviousValue: previousValue})
+}
+
+// CompareAndSet updates the value at pos only if it is still equal to expected at the moment the server applies it.
+// Otherwise the operation is rolled back and the rejection handler receives *state.ConditionFailedError.
+func (c *ClientOf[T]) CompareAndSet(pos int, expected, value T) error {
+	return c.modify(&state.OpCompareAndSetOf[T]{Position: pos, Expected: expected, Value: value})
+}
+
+// SetRejectionHandler registers a callback for operations the server refused to apply
+func (c *ClientOf[T]) SetRejectionHandler(handler func(op state.Operation, err error)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onRejected = handler
+}
+
+// SetDivergenceHandler registers a callback for the moments the client finds out its state differs from the server's.
+// The client resynchronizes itself right after that.
+func (c *ClientOf[T]) SetDivergenceHandler(handler func(version int, expected, actual uint64)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onDivergence = handler
+}
+
+// Add increments the value at pos by delta; concurrent additions to the same element do not overwrite each other.
+// Only documents of int32 elements support it.
+func (c *ClientOf[T]) Add(pos int, delta int32) error {
+	if _, err := c.state.Get(pos); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	overflow := c.overflow
+	c.mutex.Unlock()
+	// the previous value is captured when the operation is applied locally
+	return c.modify(&state.OpAdd{Position: pos, Delta: delta, Overflow: overflow})
+}
+
+// SetOverflowPolicy defines how further additions behave when the result does not fit into int32
+func (c *ClientOf[T]) SetOverflowPolicy(policy state.OverflowPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.overflow = policy
 }
 
-func (c *Client) Batch(operations []state.Operation) error {
+func (c *ClientOf[T]) Move(from, to int) error {
+	return c.modify(&state.OpMoveOf[T]{From: from, To: to})
+}
+
+func (c *ClientOf[T]) Batch(operations []state.Operation) error {
 	return c.modify(&state.OpBatch{Operations: operations})
 }
 
-func (c *Client) Get(pos int) (int32, error) {
+func (c *ClientOf[T]) Get(pos int) (T, error) {
 	return c.state.Get(pos)
 }
 
-func (c *Client) Array() []int32 {
+func (c *ClientOf[T]) Array() []T {
 	return c.state.Copy()
 }
 
-func (c *Client) Size() int {
+// RangeSum returns the sum of the elements in [from, to) of the local array
+func (c *ClientOf[T]) RangeSum(from, to int) (int64, error) {
+	return c.state.RangeSum(from, to)
+}
+
+// RangeMin returns the minimal element in [from, to) of the local array
+func (c *ClientOf[T]) RangeMin(from, to int) (T, error) {
+	return c.state.RangeMin(from, to)
+}
+
+// RangeMax returns the maximal element in [from, to) of the local array
+func (c *ClientOf[T]) RangeMax(from, to int) (T, error) {
+	return c.state.RangeMax(from, to)
+}
+
+// EnableIndex makes the client maintain the index of values in the local array, speeding up IndexOf and CountOf
+func (c *ClientOf[T]) EnableIndex() {
+	c.state.EnableIndex()
+}
+
+// IndexOf returns the first position of the value in the local array or -1 if there is none
+func (c *ClientOf[T]) IndexOf(value T) int {
+	return c.state.IndexOf(value)
+}
+
+func (c *ClientOf[T]) Contains(value T) bool {
+	return c.state.Contains(value)
+}
+
+// CountOf returns the number of occurrences of the value in the local array
+func (c *ClientOf[T]) CountOf(value T) int {
+	return c.state.CountOf(value)
+}
+
+// Search finds the value in the local array of a sorted document with binary search, returning the first position
+// holding it, or the one it would be inserted at, and whether it is there
+func (c *ClientOf[T]) Search(value T) (int, bool) {
+	return c.state.Search(value)
+}
+
+// ArrayAt requests the array as it was at some past version from the server
+func (c *ClientOf[T]) ArrayAt(version int) ([]T, error) {
+	var array []T
+	errs := make(chan error)
+	c.conn.SendWithCallback(&event.ClientAskForState{Version: version}, func(rawEvent event.Event, err error) {
+		defer close(errs)
+		if err != nil {
+			errs <- fmt.Errorf("could not get array at version %d: %w", version, err)
+			return
+		}
+		casted, ok := rawEvent.(*event.ServerStateResponseOf[T])
+		if !ok {
+			errs <- fmt.Errorf("received unexpected response to state request: %T", rawEvent)
+			return
+		}
+		array = casted.Array
+	})
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return array, nil
+}
+
+// Blame tells who and when produced every element in [from, to) of the server's array at the returned version
+func (c *ClientOf[T]) Blame(from, to int) (int, []state.Metadata, error) {
+	var version int
+	var blame []state.Metadata
+	errs := make(chan error)
+	c.conn.SendWithCallback(&event.ClientAskForBlame{From: from, To: to}, func(rawEvent event.Event, err error) {
+		defer close(errs)
+		if err != nil {
+			errs <- fmt.Errorf("could not blame [%d, %d): %w", from, to, err)
+			return
+		}
+		casted, ok := rawEvent.(*event.ServerBlameResponse)
+		if !ok {
+			errs <- fmt.Errorf("received unexpected response to blame request: %T", rawEvent)
+			return
+		}
+		version, blame = casted.Version, casted.Blame
+	})
+	for err := range errs {
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return version, blame, nil
+}
+
+func (c *ClientOf[T]) Size() int {
 	return c.state.Size()
 }
 
-func (c *Client) modify(op state.Operation) error {
+func (c *ClientOf[T]) modify(op state.Operation) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	return c.submit(op, func(version int, committed state.Operation) {
+		c.pushHistory(&c.undoStack, version, committed)
+		c.redoStack = nil
+	})
+}
+
+// submit applies the operation locally and sends it to the server; onCommit is called under the lock
+// with the version the operation was committed at and its final (transformed) form
+func (c *ClientOf[T]) submit(op state.Operation, onCommit func(version int, committed state.Operation)) error {
 	if c.clientConn == nil {
 		// offline mode
 		if err := c.state.Perform(op); err != nil {
@@ -151,8 +335,19 @@ func (c *Client) modify(op state.Operation) error {
 		return err
 	}
 	version := c.version
+	c.operationID++
+	metadata := state.Metadata{ClientID: c.id, OperationID: c.operationID}
 	c.awaitingResponse = true
-	c.conn.SendWithCallback(&event.ClientOperation{Version: c.version, Operation: op}, func(rawEvent event.Event, err error) {
+	request := &event.ClientOperation{Version: c.version, Operation: op, Metadata: metadata}
+	retries := 0
+	var callback func(rawEvent event.Event, err error)
+	callback = func(rawEvent event.Event, err error) {
+		if errors.Is(err, connection.ErrResponseLost) && retries < maxRetries {
+			// the server recognizes the retry and answers with the original result instead of applying it twice
+			retries++
+			c.conn.SendWithCallback(request, callback)
+			return
+		}
 		c.mutex.Lock()
 		defer func() {
 			c.awaitingResponse = false
@@ -167,40 +362,94 @@ func (c *Client) modify(op state.Operation) error {
 			return
 		}
 		if err != nil {
-			fmt.Printf("received error response to client operation %v: %v\n", op, err)
+			if c.onRejected != nil {
+				go c.onRejected(op, err)
+			} else {
+				fmt.Printf("received error response to client operation %v: %v\n", op, err)
+			}
 		}
 		casted, ok := rawEvent.(*event.ServerOperationResponse)
 		if !ok {
-			panic(fmt.Errorf("received unexpected response to client operation: %T", rawEvent))
+			if rawEvent != nil {
+				panic(fmt.Errorf("received unexpected response to client operation: %T", rawEvent))
+			}
+			// no response at all: rolling back, diffs bring the operation back if the server has applied it
+			casted = &event.ServerOperationResponse{Rollback: true}
 		}
 
 		if casted.Rollback {
 			err = c.state.RollbackAndPerformMany(op, casted.Diff)
-			if casted.Diff != nil {
+			if len(casted.Diff) != 0 {
 				c.version += len(casted.Diff)
+				if err == nil {
+					onCommit(c.version-1, casted.Diff[len(casted.Diff)-1])
+				}
 			}
 		} else {
 			err = c.state.PerformMany(casted.Diff, 0)
 			if casted.Diff != nil {
 				c.version += len(casted.Diff)
 			}
+			if err == nil {
+				onCommit(c.version, op)
+			}
 			c.version++
 		}
 
 		if err != nil {
 			panic(fmt.Errorf("could not process server's response to operation: %w", err))
 		}
-	})
+		if err = c.verify(casted.Metadata); err != nil {
+			panic(err)
+		}
+	}
+	c.conn.SendWithCallback(request, callback)
+	return nil
+}
+
+// verify compares the checksum of the state with the one the server had at the same version, that is the version
+// of the last metadata entry, and repairs the client if they differ
+func (c *ClientOf[T]) verify(metadata []state.Metadata) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	last := metadata[len(metadata)-1]
+	if last.Version+1 != c.version {
+		return nil
+	}
+	if actual := c.state.Checksum(); actual != last.Checksum {
+		if c.onDivergence != nil {
+			go c.onDivergence(last.Version+1, last.Checksum, actual)
+		} else {
+			fmt.Printf("diverged from the server at version %d: checksum %x instead of %x, resynchronizing\n", last.Version+1, actual, last.Checksum)
+		}
+		if _, err := c.repair(); err != nil {
+			fmt.Printf("could not repair the client, reinitializing: %v\n", err)
+			if err := c.reinitialize(); err != nil {
+				return fmt.Errorf("could not resynchronize after divergence: %w", err)
+			}
+		}
+	}
 	return nil
 }
 
-func (c *Client) sendOfflineChanges() error {
+func (c *ClientOf[T]) sendOfflineChanges() error {
 	if len(c.offlineOperations) == 0 {
 		return nil
 	}
-	if err := c.modify(&state.OpBatch{Operations: c.offlineOperations}); err != nil {
+	if err := c.submit(&state.OpBatch{Operations: c.offlineOperations}, func(version int, committed state.Operation) {
+		c.pushHistory(&c.undoStack, version, committed)
+	}); err != nil {
 		return err
 	}
 	c.offlineOperations = make([]state.Operation, 0)
 	return nil
 }
+
+func newClientID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Errorf("could not generate client id: %w", err))
+	}
+	return hex.EncodeToString(id)
+}
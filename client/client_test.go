@@ -0,0 +1,241 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RinesThaix/homeTask/connection"
+	"github.com/RinesThaix/homeTask/event"
+	"github.com/RinesThaix/homeTask/server"
+	"github.com/RinesThaix/homeTask/state"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDivergenceResync(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	writer, diverged := NewClient(srv), NewClient(srv)
+	for _, c := range []*Client{writer, diverged} {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	detected := make(chan int, 1)
+	diverged.SetDivergenceHandler(func(version int, expected, actual uint64) {
+		detected <- version
+	})
+	// imitating imperfect transformation: the state changes without the server knowing
+	if err := diverged.state.Perform(&state.OpUpdate{Position: 3, Value: -1}); err != nil {
+		t.Errorf("could not corrupt state: %v", err)
+	}
+	if err := writer.Insert(0, 1); err != nil {
+		t.Errorf("could not insert: %v", err)
+	}
+	select {
+	case version := <-detected:
+		if version != 1 {
+			t.Errorf("divergence detected at unexpected version %d", version)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("divergence was not detected")
+		return
+	}
+	time.Sleep(time.Millisecond * 100)
+	expected, actual := srv.Array(), diverged.Array()
+	if len(expected) != len(actual) {
+		t.Errorf("client was not resynchronized: %v instead of %v", actual, expected)
+		return
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Errorf("client was not resynchronized: %v instead of %v", actual, expected)
+			return
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	srv := server.NewServer(10_000)
+	srv.Initialize()
+	c := NewClient(srv)
+	if err := c.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	if err := c.state.Perform(&state.OpUpdate{Position: 5_000, Value: -1}); err != nil {
+		t.Errorf("could not corrupt state: %v", err)
+	}
+	c.mutex.Lock()
+	downloaded, err := c.repair()
+	c.mutex.Unlock()
+	if err != nil {
+		t.Errorf("could not repair: %v", err)
+	}
+	if downloaded != 1 {
+		t.Errorf("expected a single leaf to be downloaded, got %d", downloaded)
+	}
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(c.Array()) {
+		t.Errorf("client was not repaired")
+	}
+
+	// replicas of different lengths differ in the leaves at the end
+	for _, corrupt := range []state.Operation{&state.OpDelete{Position: 9_999}, &state.OpInsert{Position: 10_000, Value: -1}} {
+		if err := c.state.Perform(corrupt); err != nil {
+			t.Errorf("could not corrupt state: %v", err)
+		}
+		c.mutex.Lock()
+		_, err := c.repair()
+		c.mutex.Unlock()
+		if err != nil {
+			t.Errorf("could not repair after %v: %v", corrupt, err)
+		}
+		if fmt.Sprint(srv.Array()) != fmt.Sprint(c.Array()) {
+			t.Errorf("client was not repaired after %v", corrupt)
+		}
+	}
+}
+
+func TestChunkedInitialization(t *testing.T) {
+	srv := server.NewServer(1_000)
+	srv.Initialize()
+	c := NewClient(srv)
+	c.chunkSize = 100
+	chunks, failAfter := 0, 4
+	handle := c.conn.SendFunc
+	c.conn.SendFunc = func(rawEvent event.ClientEvent) (event.Event, error) {
+		if _, ok := rawEvent.(*event.ClientAskForChunk); ok {
+			if chunks == failAfter {
+				return nil, connection.ErrResponseLost
+			}
+			chunks++
+		}
+		return handle(rawEvent)
+	}
+	var progress []int
+	c.SetProgressHandler(func(loaded, total int) {
+		progress = append(progress, loaded)
+	})
+	if err := c.Initialize(); err == nil {
+		t.Errorf("initialization succeeded despite the disconnect")
+	}
+	if loaded, total := c.Progress(); loaded != 400 || total != 1_000 {
+		t.Errorf("unexpected progress after the disconnect: %d of %d", loaded, total)
+	}
+	if partial := c.Partial(); fmt.Sprint(partial) != fmt.Sprint(srv.Array()[:400]) {
+		t.Errorf("unexpected partially loaded state: %v", partial)
+	}
+	failAfter = -1
+	if err := c.Initialize(); err != nil {
+		t.Errorf("could not resume initialization: %v", err)
+	}
+	if chunks != 10 {
+		t.Errorf("expected 10 chunks to be downloaded in total, got %d", chunks)
+	}
+	if len(progress) != 10 || progress[9] != 1_000 {
+		t.Errorf("unexpected progress reports: %v", progress)
+	}
+	if _, err := handle(&event.ClientAskForChunk{Session: 1, Offset: 0, Size: 100}); !errors.Is(err, server.ErrUnknownSnapshot) {
+		t.Errorf("snapshot was kept after the client had got everything: %v", err)
+	}
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(c.Array()) {
+		t.Errorf("client was not initialized")
+	}
+
+	// the server handles the last chunk request, but its response never comes back
+	lost := NewClient(srv)
+	lost.chunkSize = 100
+	starts, lastLost := 0, false
+	handleLost := lost.conn.SendFunc
+	lost.conn.SendFunc = func(rawEvent event.ClientEvent) (event.Event, error) {
+		if _, ok := rawEvent.(*event.ClientStartInitialization); ok {
+			starts++
+		}
+		response, err := handleLost(rawEvent)
+		if chunk, ok := rawEvent.(*event.ClientAskForChunk); ok && chunk.Offset == 900 && !lastLost {
+			lastLost = true
+			return nil, connection.ErrResponseLost
+		}
+		return response, err
+	}
+	if err := lost.Initialize(); err == nil {
+		t.Errorf("initialization succeeded despite the lost response")
+	}
+	if err := lost.Initialize(); err != nil {
+		t.Errorf("could not resume initialization: %v", err)
+	}
+	if starts != 1 {
+		t.Errorf("expected the download to be resumed, but it was started %d times", starts)
+	}
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(lost.Array()) {
+		t.Errorf("client was not initialized after the lost response")
+	}
+
+	empty := NewClient(server.NewServer(0))
+	if err := empty.Initialize(); err != nil {
+		t.Errorf("could not initialize client of empty document: %v", err)
+	}
+	if len(empty.Array()) != 0 {
+		t.Errorf("client of empty document got %v", empty.Array())
+	}
+}
+
+func TestRetryAfterLostResponse(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	c := NewClient(srv)
+	if err := c.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	// attempts are sent from other goroutines
+	sent, lost := int32(0), int32(2)
+	handle := c.conn.SendFunc
+	c.conn.SendFunc = func(rawEvent event.ClientEvent) (event.Event, error) {
+		response, err := handle(rawEvent)
+		if _, ok := rawEvent.(*event.ClientOperation); ok {
+			// the server gets every attempt, but the responses to the first ones never come back
+			if atomic.AddInt32(&sent, 1) <= lost {
+				return nil, connection.ErrResponseLost
+			}
+		}
+		return response, err
+	}
+	initial := srv.Array()[2]
+	if err := c.Add(2, 5); err != nil {
+		t.Errorf("could not add to pos 2: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if sent := atomic.LoadInt32(&sent); sent != lost+1 {
+		t.Errorf("expected operation to be sent %d times, got %d", lost+1, sent)
+	}
+	if value := srv.Array()[2]; value != initial+5 {
+		t.Errorf("retried operation was not committed exactly once: expected %d, got %d", initial+5, value)
+	}
+	if value, _ := c.Get(2); value != initial+5 {
+		t.Errorf("client did not keep its operation: expected %d, got %d", initial+5, value)
+	}
+	if err := c.Add(2, 1); err != nil {
+		t.Errorf("could not add after retries: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if value := srv.Array()[2]; value != initial+6 {
+		t.Errorf("operation after retries was not committed: expected %d, got %d", initial+6, value)
+	}
+}
+
+func TestRunePositions(t *testing.T) {
+	text := "aé👋b"
+	for pos, offset := range []int{0, 1, 3, 7, 8} {
+		if actual, err := ByteOffset(text, pos); err != nil || actual != offset {
+			t.Errorf("rune %d starts at byte %d instead of %d: %v", pos, actual, offset, err)
+		}
+		if actual, err := RunePosition(text, offset); err != nil || actual != pos {
+			t.Errorf("byte %d starts rune %d instead of %d: %v", offset, actual, pos, err)
+		}
+	}
+	if _, err := RunePosition(text, 2); err == nil {
+		t.Errorf("byte in the middle of a rune was converted")
+	}
+	if _, err := ByteOffset(text, 5); err == nil {
+		t.Errorf("position past the end was converted")
+	}
+}
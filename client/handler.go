@@ -5,11 +5,13 @@ import (
 	"github.com/RinesThaix/homeTask/event"
 )
 
-type Handler struct {
-	client *Client
+type HandlerOf[T comparable] struct {
+	client *ClientOf[T]
 }
 
-func (h *Handler) Handle(rawEvent event.ServerEvent) error {
+type Handler = HandlerOf[int32]
+
+func (h *HandlerOf[T]) Handle(rawEvent event.ServerEvent) error {
 	switch e := rawEvent.(type) {
 	case *event.ServerDiff:
 		h.client.mutex.Lock()
@@ -21,7 +23,9 @@ func (h *Handler) Handle(rawEvent event.ServerEvent) error {
 		if clientVersion >= e.Version + len(e.Diff) {
 			return nil
 		}
-		if e.Version > clientVersion {
+		// the event is shared between all the connections, so it must not be modified
+		version, diff, metadata := e.Version, e.Diff, e.Metadata
+		if version > clientVersion {
 			fmt.Printf("i'm too out of date, requesting more changes\n")
 			errors := make(chan error)
 			h.client.conn.SendWithCallback(&event.ClientAskForDiff{Version: clientVersion}, func(rawEvent event.Event, err error) {
@@ -35,8 +39,8 @@ func (h *Handler) Handle(rawEvent event.ServerEvent) error {
 					errors <- fmt.Errorf("received unexpected response for diff request: %T", rawEvent)
 					return
 				}
-				e.Diff = casted.Diff
-				e.Version = clientVersion
+				diff, metadata = casted.Diff, casted.Metadata
+				version = clientVersion
 			})
 			for err := range errors {
 				if err != nil {
@@ -44,11 +48,11 @@ func (h *Handler) Handle(rawEvent event.ServerEvent) error {
 				}
 			}
 		}
-		if err := h.client.state.PerformMany(e.Diff, clientVersion - e.Version); err != nil {
+		if err := h.client.state.PerformMany(diff, clientVersion - version); err != nil {
 			return fmt.Errorf("could not apply server diff: %w", err)
 		}
-		h.client.version = e.Version + len(e.Diff)
-		return nil
+		h.client.version = version + len(diff)
+		return h.client.verify(metadata)
 	default:
 		return fmt.Errorf("unknown event: %T", e)
 	}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"fmt"
+	"github.com/RinesThaix/homeTask/connection"
+	"github.com/RinesThaix/homeTask/event"
+)
+
+const repairLeafSize = 1024
+
+// Repair brings the client to the current version of the server, downloading only the parts of the array that differ
+func (c *ClientOf[T]) Repair() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.repair()
+	return err
+}
+
+// repair compares Merkle trees of the client and the server from the root down; returns the number of leaves downloaded
+func (c *ClientOf[T]) repair() (int, error) {
+	if c.awaitingResponse {
+		return 0, fmt.Errorf("could not repair: awaiting response from the server for previous operation")
+	}
+	rawEvent, err := ask(c.conn, &event.ClientRepairStart{LeafSize: repairLeafSize})
+	if err != nil {
+		return 0, fmt.Errorf("could not start repair: %w", err)
+	}
+	start, ok := rawEvent.(*event.ServerRepairStart)
+	if !ok {
+		return 0, fmt.Errorf("received unexpected response to repair start: %T", rawEvent)
+	}
+	defer ask(c.conn, &event.ClientReleaseSession{Session: start.Session})
+	tree := c.state.MerkleTree(start.Size, repairLeafSize)
+	if tree.Depth() != start.Depth {
+		return 0, fmt.Errorf("could not repair: server's tree has %d levels, whilst client's one has %d", start.Depth, tree.Depth())
+	}
+	var mismatched []int
+	if tree.Root() != start.Root {
+		mismatched = []int{0}
+	}
+	for level := 1; level < tree.Depth() && len(mismatched) > 0; level++ {
+		var children []int
+		for _, index := range mismatched {
+			children = append(children, tree.Children(level-1, index)...)
+		}
+		rawEvent, err := ask(c.conn, &event.ClientRepairNodes{Session: start.Session, Level: level, Indices: children})
+		if err != nil {
+			return 0, fmt.Errorf("could not get level %d of server's tree: %w", level, err)
+		}
+		nodes, ok := rawEvent.(*event.ServerRepairNodes)
+		if !ok {
+			return 0, fmt.Errorf("received unexpected response to repair nodes request: %T", rawEvent)
+		}
+		mismatched = mismatched[:0]
+		for i, index := range children {
+			if tree.Node(level, index) != nodes.Hashes[i] {
+				mismatched = append(mismatched, index)
+			}
+		}
+	}
+	if size := c.state.Size(); size > start.Size {
+		if err := c.state.Replace(start.Size, size, nil); err != nil {
+			return 0, err
+		}
+	}
+	if len(mismatched) > 0 {
+		rawEvent, err := ask(c.conn, &event.ClientRepairLeaves{Session: start.Session, Indices: mismatched})
+		if err != nil {
+			return 0, fmt.Errorf("could not get leaves of server's tree: %w", err)
+		}
+		leaves, ok := rawEvent.(*event.ServerRepairLeavesOf[T])
+		if !ok {
+			return 0, fmt.Errorf("received unexpected response to repair leaves request: %T", rawEvent)
+		}
+		// patching from the end, so that the leaves before keep their positions; the ones beyond the end are appended
+		for i := len(mismatched) - 1; i >= 0; i-- {
+			from, to := tree.Leaf(mismatched[i])
+			size := c.state.Size()
+			if from > size {
+				from = size
+			}
+			if to > size {
+				to = size
+			}
+			if err := c.state.Replace(from, to, leaves.Leaves[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	c.version = start.Version
+	return len(mismatched), nil
+}
+
+// ask sends the event to the server and waits for the response
+func ask(conn *connection.ServerConnection, request event.ClientEvent) (event.Event, error) {
+	var response event.Event
+	errs := make(chan error)
+	conn.SendWithCallback(request, func(rawEvent event.Event, err error) {
+		defer close(errs)
+		if err != nil {
+			errs <- err
+			return
+		}
+		response = rawEvent
+	})
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"github.com/RinesThaix/homeTask/server"
+	"github.com/RinesThaix/homeTask/state"
+	"unicode/utf8"
+)
+
+// TextClient edits the text document of a server created with server.NewTextServer. Positions count runes rather
+// than bytes, so that they never point into the middle of a UTF-8 sequence; see RunePosition and ByteOffset.
+type TextClient struct {
+	*Client
+}
+
+func NewTextClient(server *server.Server) *TextClient {
+	return &TextClient{Client: NewClient(server)}
+}
+
+// InsertText inserts the text so that its first rune ends up at pos
+func (c *TextClient) InsertText(pos int, text string) error {
+	if !utf8.ValidString(text) {
+		return fmt.Errorf("could not insert text at %d: it is not valid UTF-8", pos)
+	}
+	if text == "" {
+		return nil
+	}
+	return c.modify(&state.OpInsertText{Position: pos, Text: text})
+}
+
+// DeleteText removes length runes starting at pos
+func (c *TextClient) DeleteText(pos, length int) error {
+	if length == 0 {
+		return nil
+	}
+	return c.modify(&state.OpDeleteText{Position: pos, Length: length})
+}
+
+// ReplaceText replaces length runes starting at pos with the text in a single operation
+func (c *TextClient) ReplaceText(pos, length int, text string) error {
+	if !utf8.ValidString(text) {
+		return fmt.Errorf("could not replace text at %d: it is not valid UTF-8", pos)
+	}
+	return c.modify(&state.OpBatch{Operations: []state.Operation{
+		&state.OpDeleteText{Position: pos, Length: length},
+		&state.OpInsertText{Position: pos, Text: text},
+	}})
+}
+
+// Text returns the whole local document
+func (c *TextClient) Text() string {
+	return string(c.Array())
+}
+
+// TextRange returns the runes in [from, to) of the local document
+func (c *TextClient) TextRange(from, to int) (string, error) {
+	runes, err := c.state.Range(from, to)
+	if err != nil {
+		return "", err
+	}
+	return string(runes), nil
+}
+
+// RunePosition returns the position of the rune starting at the byte offset into the text
+func RunePosition(text string, offset int) (int, error) {
+	if offset < 0 || offset > len(text) || offset < len(text) && !utf8.RuneStart(text[offset]) {
+		return 0, fmt.Errorf("byte %d does not start a rune of the text of %d bytes", offset, len(text))
+	}
+	return utf8.RuneCountInString(text[:offset]), nil
+}
+
+// ByteOffset returns the byte offset the rune at the position starts at in the text
+func ByteOffset(text string, pos int) (int, error) {
+	if pos < 0 {
+		return 0, fmt.Errorf("rune position must be non-negative: %d", pos)
+	}
+	offset := 0
+	for i := 0; i < pos; i++ {
+		if offset >= len(text) {
+			return 0, fmt.Errorf("there are only %d runes in the text, not %d", i, pos)
+		}
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return offset, nil
+}
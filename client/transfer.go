@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RinesThaix/homeTask/event"
+	"github.com/RinesThaix/homeTask/server"
+)
+
+const defaultChunkSize = 1 << 16
+
+// transfer is the initial state being downloaded chunk by chunk from a snapshot the server keeps for the client
+type transfer[T comparable] struct {
+	session int
+	version int
+	array   []T
+	sorted  bool
+	loaded  int
+}
+
+// SetProgressHandler registers a callback, that is called after every chunk of the initial state is downloaded
+func (c *ClientOf[T]) SetProgressHandler(handler func(loaded, total int)) {
+	c.transferLock.Lock()
+	defer c.transferLock.Unlock()
+	c.onProgress = handler
+}
+
+// Progress returns how many elements of the initial state are downloaded and how many there are in total;
+// both are zero when no download is in progress
+func (c *ClientOf[T]) Progress() (int, int) {
+	c.transferLock.Lock()
+	defer c.transferLock.Unlock()
+	if c.transfer == nil {
+		return 0, 0
+	}
+	return c.transfer.loaded, len(c.transfer.array)
+}
+
+// Partial returns the part of the initial state downloaded so far
+func (c *ClientOf[T]) Partial() []T {
+	c.transferLock.Lock()
+	defer c.transferLock.Unlock()
+	if c.transfer == nil {
+		return nil
+	}
+	result := make([]T, c.transfer.loaded)
+	copy(result, c.transfer.array)
+	return result
+}
+
+// download fetches the initial state in chunks. If it is interrupted, the next call resumes from the last chunk
+// received, as long as the server still keeps the snapshot.
+func (c *ClientOf[T]) download() (int, []T, bool, error) {
+	c.transferLock.Lock()
+	t := c.transfer
+	c.transferLock.Unlock()
+	if t == nil {
+		var err error
+		if t, err = c.startTransfer(); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	for t.loaded < len(t.array) {
+		rawEvent, err := ask(c.conn, &event.ClientAskForChunk{Session: t.session, Offset: t.loaded, Size: c.chunkSize})
+		if errors.Is(err, server.ErrUnknownSnapshot) {
+			// the snapshot has expired while we were away, starting over
+			if t, err = c.startTransfer(); err != nil {
+				return 0, nil, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, nil, false, fmt.Errorf("could not download chunk at %d: %w", t.loaded, err)
+		}
+		chunk, ok := rawEvent.(*event.ServerChunkOf[T])
+		if !ok {
+			return 0, nil, false, fmt.Errorf("received unexpected response to chunk request: %T", rawEvent)
+		}
+		if chunk.Offset != t.loaded || len(chunk.Array) == 0 {
+			return 0, nil, false, fmt.Errorf("received chunk of %d elements at %d, expected one at %d", len(chunk.Array), chunk.Offset, t.loaded)
+		}
+		c.transferLock.Lock()
+		copy(t.array[t.loaded:], chunk.Array)
+		t.loaded += len(chunk.Array)
+		onProgress := c.onProgress
+		c.transferLock.Unlock()
+		if onProgress != nil {
+			onProgress(t.loaded, len(t.array))
+		}
+	}
+	c.transferLock.Lock()
+	c.transfer = nil
+	c.transferLock.Unlock()
+	if len(t.array) > 0 {
+		// the snapshot expires anyway, if the server does not get this
+		ask(c.conn, &event.ClientReleaseSession{Session: t.session})
+	}
+	return t.version, t.array, t.sorted, nil
+}
+
+func (c *ClientOf[T]) startTransfer() (*transfer[T], error) {
+	rawEvent, err := ask(c.conn, &event.ClientStartInitialization{})
+	if err != nil {
+		return nil, err
+	}
+	start, ok := rawEvent.(*event.ServerInitializationStart)
+	if !ok {
+		return nil, fmt.Errorf("received unexpected response to initialization start: %T", rawEvent)
+	}
+	t := &transfer[T]{session: start.Session, version: start.Version, array: make([]T, start.Size), sorted: start.Sorted}
+	c.transferLock.Lock()
+	c.transfer = t
+	c.transferLock.Unlock()
+	return t, nil
+}
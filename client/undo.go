@@ -0,0 +1,124 @@
+package client
+
+import (
+	"fmt"
+	"github.com/RinesThaix/homeTask/event"
+	"github.com/RinesThaix/homeTask/state"
+)
+
+const maxUndoDepth = 100
+
+// committedOperation is an own operation of the client along with the version it was committed at
+type committedOperation struct {
+	version   int
+	operation state.Operation
+}
+
+// Undo reverts the latest own operation of the client, keeping everything done by others since then.
+// Returns *state.RevertConflictError if someone else has modified or deleted the element since then.
+func (c *ClientOf[T]) Undo() error {
+	return c.revert(&c.undoStack, func(version int, committed state.Operation) {
+		c.pushHistory(&c.redoStack, version, committed)
+	})
+}
+
+// Redo reapplies the latest operation reverted by Undo
+func (c *ClientOf[T]) Redo() error {
+	return c.revert(&c.redoStack, func(version int, committed state.Operation) {
+		c.pushHistory(&c.undoStack, version, committed)
+	})
+}
+
+// revert submits the inverse of the operation on top of the stack, transformed past all the operations committed after it.
+// The operation leaves the stack only once its inverse is committed, so that a rejected one could be reverted again.
+func (c *ClientOf[T]) revert(stack *[]committedOperation, onCommit func(version int, committed state.Operation)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		if c.clientConn == nil {
+			return fmt.Errorf("could not revert: client is offline")
+		}
+		if c.awaitingResponse {
+			return fmt.Errorf("could not revert: awaiting response from the server for previous operation")
+		}
+		if len(*stack) == 0 {
+			return fmt.Errorf("could not revert: there are no operations left")
+		}
+		last := (*stack)[len(*stack)-1]
+		version := c.version
+		// diffs and responses keep being processed while the server is asked for the later operations
+		c.mutex.Unlock()
+		later, metadata, err := c.operationsSince(last.version+1, version)
+		c.mutex.Lock()
+		if err != nil {
+			return fmt.Errorf("could not revert %v: %w", last.operation, err)
+		}
+		if version != c.version || len(*stack) == 0 || (*stack)[len(*stack)-1] != last {
+			// something has been committed meanwhile
+			continue
+		}
+		inverse := last.operation.Inverse()
+		if c.state.Sorted() {
+			inverse = state.SortedFormOf[T](inverse)
+		}
+		for i, op := range later {
+			if metadata[i].ClientID == c.id {
+				// own later operations are reverted before this one, so they do not get in its way
+				if _, err := c.transformer.Transform([]state.Operation{op}, &inverse, c.state); err != nil {
+					return fmt.Errorf("could not revert %v: %w", last.operation, err)
+				}
+				continue
+			}
+			if reason, err := c.transformer.TransformReverted(op, &inverse, c.state); err != nil {
+				return fmt.Errorf("could not revert %v: %w", last.operation, err)
+			} else if reason != "" {
+				return &state.RevertConflictError{Version: last.version, Operation: last.operation, ConflictingVersion: last.version + 1 + i, Conflicting: op, Reason: reason}
+			}
+		}
+		return c.submit(inverse, func(version int, committed state.Operation) {
+			if len(*stack) != 0 && (*stack)[len(*stack)-1] == last {
+				*stack = (*stack)[:len(*stack)-1]
+			}
+			onCommit(version, committed)
+		})
+	}
+}
+
+// operationsSince returns operations the client has already applied in [from, to) along with their metadata
+func (c *ClientOf[T]) operationsSince(from, to int) ([]state.Operation, []state.Metadata, error) {
+	if from >= to {
+		return nil, nil, nil
+	}
+	var operations []state.Operation
+	var metadata []state.Metadata
+	errs := make(chan error)
+	c.conn.SendWithCallback(&event.ClientAskForDiff{Version: from}, func(rawEvent event.Event, err error) {
+		defer close(errs)
+		if err != nil {
+			errs <- err
+			return
+		}
+		casted, ok := rawEvent.(*event.ServerDiffResponse)
+		if !ok {
+			errs <- fmt.Errorf("received unexpected response for diff request: %T", rawEvent)
+			return
+		}
+		operations, metadata = casted.Diff, casted.Metadata
+	})
+	for err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(operations) < to-from || len(metadata) < to-from {
+		return nil, nil, fmt.Errorf("server returned %d operations since version %d, expected at least %d", len(operations), from, to-from)
+	}
+	return operations[:to-from], metadata[:to-from], nil
+}
+
+func (c *ClientOf[T]) pushHistory(stack *[]committedOperation, version int, op state.Operation) {
+	*stack = append(*stack, committedOperation{version: version, operation: op})
+	if len(*stack) > maxUndoDepth {
+		*stack = (*stack)[1:]
+	}
+}
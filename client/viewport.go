@@ -0,0 +1,239 @@
+package client
+
+import (
+	"fmt"
+	"github.com/RinesThaix/homeTask/connection"
+	"github.com/RinesThaix/homeTask/event"
+	"github.com/RinesThaix/homeTask/server"
+	"github.com/RinesThaix/homeTask/state"
+	"github.com/RinesThaix/homeTask/util"
+	"sync"
+)
+
+// ViewportClientOf replicates a range of positions instead of the whole array. Positions in its API are the global ones,
+// the range moves along with the elements inside it when something is inserted or deleted before it.
+type ViewportClientOf[T comparable] struct {
+	id       string
+	server   *server.ServerOf[T]
+	conn     *connection.ServerConnection
+	state    *state.StateOf[T]
+	viewport state.ViewportOf[T]
+
+	clientConn       *connection.ClientConnection
+	version          int
+	operationID      uint64
+	awaitingResponse bool
+	onRejected       func(op state.Operation, err error)
+	mutex            sync.Mutex
+}
+
+type ViewportClient = ViewportClientOf[int32]
+
+func NewViewportClient(server *server.Server) *ViewportClient {
+	return NewViewportClientOf(util.Int32Codec, server)
+}
+
+// NewViewportClientOf creates the viewport client of the server keeping the document of elements of type T
+func NewViewportClientOf[T comparable](codec util.Codec[T], server *server.ServerOf[T]) *ViewportClientOf[T] {
+	c := &ViewportClientOf[T]{}
+	c.id = newClientID()
+	c.server = server
+	c.state = state.NewStateWithCodec(codec, util.BackendBlocked, make([]T, 0))
+	c.conn = &connection.ServerConnection{SendFunc: server.Handler.Handle}
+	return c
+}
+
+func (c *ViewportClientOf[T]) ID() string {
+	return c.id
+}
+
+// Subscribe replaces the replicated range with [from, to)
+func (c *ViewportClientOf[T]) Subscribe(from, to int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.awaitingResponse {
+		return fmt.Errorf("could not subscribe: awaiting response from the server for previous operation")
+	}
+	rawEvent, err := ask(c.conn, &event.ClientSubscribeViewport{From: from, To: to})
+	if err != nil {
+		return fmt.Errorf("could not subscribe to [%d, %d): %w", from, to, err)
+	}
+	casted, ok := rawEvent.(*event.ServerViewportResponseOf[T])
+	if !ok {
+		return fmt.Errorf("received unexpected response to viewport subscription: %T", rawEvent)
+	}
+	c.state.Set(casted.Array)
+	c.viewport = casted.Viewport
+	c.version = casted.Version
+	if c.clientConn == nil {
+		c.clientConn = &connection.ClientConnection{Viewport: true, SendFunc: func(event event.ServerEvent) {
+			if err := c.handle(event); err != nil {
+				panic(err)
+			}
+		}}
+		c.server.OnClientConnected(c.clientConn) // imitating handshaking
+	}
+	return nil
+}
+
+func (c *ViewportClientOf[T]) Disconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.clientConn == nil {
+		return
+	}
+	c.server.OnClientDisconnected(c.clientConn)
+	c.clientConn = nil
+}
+
+// Range returns the replicated range of positions [from, to)
+func (c *ViewportClientOf[T]) Range() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.viewport.From, c.viewport.From + c.viewport.Size
+}
+
+func (c *ViewportClientOf[T]) Get(pos int) (T, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.viewport.Contains(pos) {
+		var zero T
+		return zero, fmt.Errorf("could not get: pos %d is out of viewport [%d, %d)", pos, c.viewport.From, c.viewport.From+c.viewport.Size)
+	}
+	return c.state.Get(pos - c.viewport.From)
+}
+
+// Array returns the elements of the replicated range
+func (c *ViewportClientOf[T]) Array() []T {
+	return c.state.Copy()
+}
+
+func (c *ViewportClientOf[T]) SetRejectionHandler(handler func(op state.Operation, err error)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onRejected = handler
+}
+
+func (c *ViewportClientOf[T]) Insert(pos int, value T) error {
+	return c.modify(pos, true, func(local int) state.Operation {
+		return &state.OpInsertOf[T]{Position: local, Value: value}
+	})
+}
+
+func (c *ViewportClientOf[T]) Update(pos int, value T) error {
+	return c.modify(pos, false, func(local int) state.Operation {
+		return &state.OpUpdateOf[T]{Position: local, Value: value}
+	})
+}
+
+func (c *ViewportClientOf[T]) Delete(pos int) error {
+	return c.modify(pos, false, func(local int) state.Operation {
+		return &state.OpDeleteOf[T]{Position: local}
+	})
+}
+
+func (c *ViewportClientOf[T]) Add(pos int, delta int32) error {
+	return c.modify(pos, false, func(local int) state.Operation {
+		return &state.OpAdd{Position: local, Delta: delta}
+	})
+}
+
+// modify applies the operation at the global position locally, then sends it to the server. Whatever the response is,
+// the local operation is rolled back afterwards, and the committed one comes back with the projections of the diff.
+func (c *ViewportClientOf[T]) modify(pos int, inserting bool, create func(pos int) state.Operation) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.clientConn == nil {
+		return fmt.Errorf("could not modify: viewport is not subscribed")
+	}
+	if c.awaitingResponse {
+		return fmt.Errorf("could not modify: awaiting response from the server for previous operation")
+	}
+	if !c.viewport.Contains(pos) && !(inserting && pos == c.viewport.From+c.viewport.Size) {
+		return fmt.Errorf("could not modify: pos %d is out of viewport [%d, %d)", pos, c.viewport.From, c.viewport.From+c.viewport.Size)
+	}
+	local := create(pos - c.viewport.From)
+	if err := c.state.Perform(local); err != nil {
+		return err
+	}
+	c.viewport.Size = c.state.Size()
+	// the local operation has captured previous values, that the global one needs too
+	global := relocate[T](local, pos)
+	c.operationID++
+	c.awaitingResponse = true
+	request := &event.ClientOperation{Version: c.version, Operation: global, Metadata: state.Metadata{ClientID: c.id, OperationID: c.operationID}}
+	c.conn.SendWithCallback(request, func(rawEvent event.Event, err error) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.awaitingResponse = false
+		if err != nil {
+			if c.onRejected != nil {
+				go c.onRejected(global, err)
+			} else {
+				fmt.Printf("received error response to viewport operation %v: %v\n", global, err)
+			}
+		}
+		if err := c.state.RollbackAndPerformMany(local, nil); err != nil {
+			panic(fmt.Errorf("could not rollback viewport operation: %w", err))
+		}
+		c.viewport.Size = c.state.Size()
+		if err := c.sync(); err != nil {
+			panic(fmt.Errorf("could not synchronize viewport: %w", err))
+		}
+	})
+	return nil
+}
+
+func (c *ViewportClientOf[T]) handle(rawEvent event.ServerEvent) error {
+	switch e := rawEvent.(type) {
+	case *event.ServerDiffAvailable:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.awaitingResponse || c.clientConn == nil || e.Version <= c.version {
+			// the response to the operation synchronizes the viewport anyway
+			return nil
+		}
+		return c.sync()
+	default:
+		return fmt.Errorf("unknown event: %T", e)
+	}
+}
+
+// sync fetches projections of all the operations since the client's version onto its viewport
+func (c *ViewportClientOf[T]) sync() error {
+	rawEvent, err := ask(c.conn, &event.ClientAskForViewportDiffOf[T]{Version: c.version, Viewport: c.viewport})
+	if err != nil {
+		return err
+	}
+	casted, ok := rawEvent.(*event.ServerViewportDiffResponse)
+	if !ok {
+		return fmt.Errorf("received unexpected response for viewport diff request: %T", rawEvent)
+	}
+	for _, projection := range casted.Projections {
+		if err := c.viewport.Apply(projection, c.state); err != nil {
+			return fmt.Errorf("could not apply projection: %w", err)
+		}
+	}
+	c.version = casted.Version
+	return nil
+}
+
+// relocate returns a copy of the operation moved to the position
+func relocate[T comparable](operation state.Operation, pos int) state.Operation {
+	switch op := operation.Copy().(type) {
+	case *state.OpInsertOf[T]:
+		op.Position = pos
+		return op
+	case *state.OpUpdateOf[T]:
+		op.Position = pos
+		return op
+	case *state.OpDeleteOf[T]:
+		op.Position = pos
+		return op
+	case *state.OpAdd:
+		op.Position = pos
+		return op
+	default:
+		return op
+	}
+}
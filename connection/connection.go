@@ -1,12 +1,18 @@
 package connection
 
 import (
+	"errors"
 	"github.com/RinesThaix/homeTask/event"
 )
 
+// ErrResponseLost is returned by SendFunc when the event may have reached the server, but its response did not come back
+var ErrResponseLost = errors.New("response lost")
+
 type (
 	ClientConnection struct {
 		SendFunc func(event event.ServerEvent)
+		// Viewport connections are only notified about new versions and fetch what they need themselves
+		Viewport bool
 	}
 
 	ServerConnection struct {
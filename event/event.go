@@ -19,10 +19,51 @@ type (
 		ClientEvent
 	}
 
-	ServerInitializationResponse struct {
+	ServerInitializationResponseOf[T comparable] struct {
 		Event
 		Version int
-		Array   []int32
+		Array   []T
+		Sorted  bool
+	}
+
+	// ClientStartInitialization makes the server keep a snapshot of its current array, that the client
+	// then downloads chunk by chunk, resuming from the last chunk received after a disconnect
+	ClientStartInitialization struct {
+		ClientEvent
+	}
+
+	// ServerInitializationStart has no session for an empty array, as there is nothing to download
+	ServerInitializationStart struct {
+		Event
+		Session int
+		Version int
+		Size    int
+		// Sorted tells that the document is kept sorted, see state.State.EnableSortedMode
+		Sorted bool
+	}
+
+	ClientAskForChunk struct {
+		ClientEvent
+		Session int
+		Offset  int
+		Size    int
+	}
+
+	ServerChunkOf[T comparable] struct {
+		Event
+		Offset int
+		Array  []T
+	}
+
+	// ClientReleaseSession tells the server that the client has got everything it needed from the snapshot of
+	// the session, so that the server does not keep it until it expires
+	ClientReleaseSession struct {
+		ClientEvent
+		Session int
+	}
+
+	ServerSessionReleased struct {
+		Event
 	}
 
 	ClientAskForDiff struct {
@@ -32,26 +73,137 @@ type (
 
 	ServerDiffResponse struct {
 		Event
-		Diff []state.Operation
+		Diff     []state.Operation
+		Metadata []state.Metadata
+	}
+
+	ClientAskForState struct {
+		ClientEvent
+		Version int
+	}
+
+	ServerStateResponseOf[T comparable] struct {
+		Event
+		Version int
+		Array   []T
+	}
+
+	ClientAskForBlame struct {
+		ClientEvent
+		From int
+		To   int
+	}
+
+	ServerBlameResponse struct {
+		Event
+		Version int
+		Blame   []state.Metadata
+	}
+
+	// ClientRepairStart asks the server to build a Merkle tree over its current array; the client then compares
+	// the tree with its own one level by level and downloads the leaves that differ
+	ClientRepairStart struct {
+		ClientEvent
+		LeafSize int
+	}
+
+	ServerRepairStart struct {
+		Event
+		Session int
+		Version int
+		Size    int
+		Depth   int
+		Root    uint64
+	}
+
+	ClientRepairNodes struct {
+		ClientEvent
+		Session int
+		Level   int
+		Indices []int
+	}
+
+	ServerRepairNodes struct {
+		Event
+		Hashes []uint64
+	}
+
+	ClientRepairLeaves struct {
+		ClientEvent
+		Session int
+		Indices []int
+	}
+
+	ServerRepairLeavesOf[T comparable] struct {
+		Event
+		Leaves [][]T
+	}
+
+	// ClientSubscribeViewport asks for the elements in [From, To) only. Afterwards the client fetches projections
+	// of the diff onto its viewport instead of the diff itself.
+	ClientSubscribeViewport struct {
+		ClientEvent
+		From int
+		To   int
+	}
+
+	ServerViewportResponseOf[T comparable] struct {
+		Event
+		Version  int
+		Viewport state.ViewportOf[T]
+		Array    []T
+	}
+
+	ClientAskForViewportDiffOf[T comparable] struct {
+		ClientEvent
+		Version  int
+		Viewport state.ViewportOf[T]
+	}
+
+	ServerViewportDiffResponse struct {
+		Event
+		Version     int
+		Projections []state.Projection
 	}
 
 	ClientOperation struct {
 		ClientEvent
 		Version   int
 		Operation state.Operation
+		Metadata  state.Metadata
 	}
 
+	// Metadata describes every operation committed since the version of the client's operation,
+	// so the last one always belongs to the client's operation itself
 	ServerOperationResponse struct {
 		Event
 		Rollback bool
 		Diff     []state.Operation
+		Metadata []state.Metadata
 	}
 )
 
+// events carrying int32 elements
 type (
-	ServerDiff struct {
+	ServerInitializationResponse = ServerInitializationResponseOf[int32]
+	ServerChunk                  = ServerChunkOf[int32]
+	ServerStateResponse          = ServerStateResponseOf[int32]
+	ServerRepairLeaves           = ServerRepairLeavesOf[int32]
+	ServerViewportResponse       = ServerViewportResponseOf[int32]
+	ClientAskForViewportDiff     = ClientAskForViewportDiffOf[int32]
+)
+
+type (
+	// ServerDiffAvailable is sent instead of ServerDiff to the clients replicating a viewport only
+	ServerDiffAvailable struct {
 		ServerEvent
 		Version int
-		Diff    []state.Operation
+	}
+
+	ServerDiff struct {
+		ServerEvent
+		Version  int
+		Diff     []state.Operation
+		Metadata []state.Metadata
 	}
 )
@@ -2,9 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/RinesThaix/homeTask/client"
+	"github.com/RinesThaix/homeTask/event"
 	"github.com/RinesThaix/homeTask/server"
+	"github.com/RinesThaix/homeTask/state"
+	"github.com/RinesThaix/homeTask/util"
+	"math"
 	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,14 +21,48 @@ import (
 )
 
 func TestConsistencyParallel(t *testing.T) {
-	consistencyParallel(t, 100, 20)
-	consistencyParallel(t, 1_000_000, 40)
-	consistencyParallel(t, 10_000_000, 20)
+	consistencyParallel(t, util.BackendBlocked, 100, 20)
+	consistencyParallel(t, util.BackendBlocked, 1_000_000, 40)
+	consistencyParallel(t, util.BackendBlocked, 10_000_000, 20)
 }
 
-func consistencyParallel(t *testing.T, initialArraySize, clientsCount int) {
-	t.Logf("starting test with %d clients and %d array elements", clientsCount, initialArraySize)
-	srv := server.NewServer(initialArraySize)
+func TestConsistencyBackends(t *testing.T) {
+	consistencyParallel(t, util.BackendRope, 100_000, 20)
+	consistencyParallel(t, util.BackendSlice, 1_000, 20)
+
+	t.Logf("starting test with the array stored on disk")
+	path := filepath.Join(t.TempDir(), "document")
+	srv, err := server.NewServerOnDisk(1_000_000, path, 16)
+	if err != nil {
+		t.Fatalf("could not create server: %v", err)
+	}
+	consistencyOn(t, srv, 20)
+	if _, err := srv.CreateCheckpoint("flushed"); err != nil {
+		t.Errorf("could not create checkpoint: %v", err)
+	}
+	expected := srv.Array()
+	if err := srv.Close(); err != nil {
+		t.Fatalf("could not close server: %v", err)
+	}
+	reopened, err := server.OpenServerOnDisk(path, 16)
+	if err != nil {
+		t.Fatalf("could not reopen server: %v", err)
+	}
+	defer reopened.Close()
+	if fmt.Sprint(reopened.Array()) != fmt.Sprint(expected) {
+		t.Errorf("reopened server lost the document")
+	}
+	if checkpoints := reopened.Checkpoints(); len(checkpoints) != 1 || checkpoints[0].Name != "flushed" {
+		t.Errorf("reopened server lost the checkpoints: %v", checkpoints)
+	}
+}
+
+func consistencyParallel(t *testing.T, backend util.Backend, initialArraySize, clientsCount int) {
+	t.Logf("starting test with %d clients and %d array elements stored in %v", clientsCount, initialArraySize, backend)
+	consistencyOn(t, server.NewServerWithBackend(initialArraySize, backend), clientsCount)
+}
+
+func consistencyOn(t *testing.T, srv *server.Server, clientsCount int) {
 	srv.Initialize()
 	//t.Logf("srv array: %v", srv.Array())
 
@@ -113,11 +156,15 @@ func performRandomModification(rand *rand.Rand, client *client.Client) error {
 	if client.Size() == 0 {
 		return client.Insert(0, int32(rand.Uint32()))
 	}
-	switch rand.Intn(3) {
+	switch rand.Intn(5) {
 	case 0:
 		return client.Insert(rand.Intn(client.Size() + 1), int32(rand.Uint32()))
 	case 1:
 		return client.Update(rand.Intn(client.Size()), int32(rand.Uint32()))
+	case 2:
+		return client.Move(rand.Intn(client.Size()), rand.Intn(client.Size()))
+	case 3:
+		return client.Add(rand.Intn(client.Size()), int32(rand.Intn(100)))
 	default:
 		return client.Delete(rand.Intn(client.Size()))
 	}
@@ -148,3 +195,1066 @@ func TestOperations(t *testing.T) {
 		t.Errorf("update failed")
 	}
 }
+
+func TestMove(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	value, err := client.Get(2)
+	if err != nil {
+		t.Errorf("could not get client value at pos 2: %v", err)
+	}
+	if err = client.Move(2, 7); err != nil {
+		t.Errorf("could not move pos 2 to pos 7: %v", err)
+	}
+	if moved, _ := client.Get(7); moved != value {
+		t.Errorf("move failed: expected %d at pos 7, got %d", value, moved)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if moved := srv.Array()[7]; moved != value {
+		t.Errorf("move was not applied on server: expected %d at pos 7, got %d", value, moved)
+	}
+}
+
+func TestConcurrentMove(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	value := srv.Array()[2]
+	// both users drag the element at pos 2 having seen the same version
+	for i, to := range []int{7, 4} {
+		request := &event.ClientOperation{
+			Version:   0,
+			Operation: &state.OpMove{From: 2, To: to},
+			Metadata:  state.Metadata{ClientID: fmt.Sprintf("dragging-%d", i), OperationID: 1},
+		}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Errorf("could not move pos 2 to pos %d: %v", to, err)
+		}
+	}
+	array := srv.Array()
+	if len(array) != 10 {
+		t.Errorf("concurrent moves changed array size to %d", len(array))
+	}
+	if array[4] != value {
+		t.Errorf("last committed move did not win: expected %d at pos 4, got %v", value, array)
+	}
+	time.Sleep(time.Second)
+	if fmt.Sprint(client.Array()) != fmt.Sprint(array) {
+		t.Errorf("client did not converge: expected %v, got %v", array, client.Array())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	clients := createClients(srv, 2)
+	for _, c := range clients {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	initial := srv.Array()[3]
+	for i := 0; i < 10; i++ {
+		for _, c := range clients {
+			if err := c.Add(3, 1); err != nil {
+				t.Errorf("could not add to pos 3: %v", err)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	time.Sleep(time.Second)
+	if value := srv.Array()[3]; value != initial+20 {
+		t.Errorf("concurrent additions were lost: expected %d, got %d", initial+20, value)
+	}
+	for i, c := range clients {
+		if value, _ := c.Get(3); value != initial+20 {
+			t.Errorf("client %d did not converge: expected %d, got %d", i, initial+20, value)
+		}
+	}
+
+	clients[0].SetOverflowPolicy(state.OverflowSaturate)
+	if err := clients[0].Update(5, math.MaxInt32-1); err != nil {
+		t.Errorf("could not update pos 5: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := clients[0].Add(5, 10); err != nil {
+		t.Errorf("could not add to pos 5: %v", err)
+	}
+	if value, _ := clients[0].Get(5); value != math.MaxInt32 {
+		t.Errorf("addition did not saturate: got %d", value)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := clients[0].Undo(); err != nil {
+		t.Errorf("could not undo saturated addition: %v", err)
+	}
+	if value, _ := clients[0].Get(5); value != math.MaxInt32-1 {
+		t.Errorf("undo of saturated addition did not restore the value: got %d", value)
+	}
+
+	// the addition to a counter deleted concurrently must not land on its neighbour
+	srv = server.NewServer(10)
+	before := srv.Array()
+	for i, op := range []state.Operation{&state.OpDelete{Position: 3}, &state.OpAdd{Position: 3, Delta: 5}} {
+		request := &event.ClientOperation{Version: 0, Operation: op, Metadata: state.Metadata{ClientID: fmt.Sprintf("counting-%d", i), OperationID: 1}}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Errorf("could not perform %v: %v", op, err)
+		}
+	}
+	expected := append(append([]int32{}, before[:3]...), before[4:]...)
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(expected) {
+		t.Errorf("addition to deleted counter changed others: expected %v, got %v", expected, srv.Array())
+	}
+
+	// so must the plain update of an element deleted concurrently
+	srv = server.NewServer(10)
+	before = srv.Array()
+	for i, op := range []state.Operation{&state.OpDelete{Position: 4}, &state.OpUpdate{Position: 4, Value: -1}} {
+		request := &event.ClientOperation{Version: 0, Operation: op, Metadata: state.Metadata{ClientID: fmt.Sprintf("updating-%d", i), OperationID: 1}}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Errorf("could not perform %v: %v", op, err)
+		}
+	}
+	expected = append(append([]int32{}, before[:4]...), before[5:]...)
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(expected) {
+		t.Errorf("update of deleted element changed others: expected %v, got %v", expected, srv.Array())
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	clients := createClients(srv, 2)
+	for _, c := range clients {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	rejections := make(chan error, 1)
+	clients[1].SetRejectionHandler(func(op state.Operation, err error) {
+		rejections <- err
+	})
+	value, _ := clients[1].Get(4)
+	if err := clients[0].Update(4, value+1); err != nil {
+		t.Errorf("could not update pos 4: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	guarded := []state.Operation{
+		&state.OpCompareAndSet{Position: 4, Expected: value, Value: value},
+		&state.OpUpdate{Position: 0, Value: 42, PreviousValue: srv.Array()[0]},
+	}
+	if err := clients[1].Batch(guarded); err != nil {
+		t.Errorf("could not perform guarded batch: %v", err)
+	}
+	select {
+	case err := <-rejections:
+		var conditionErr *state.ConditionFailedError
+		if !errors.As(err, &conditionErr) {
+			t.Errorf("expected condition failure, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("guarded batch was not rejected")
+	}
+	time.Sleep(time.Second)
+	if srv.Array()[0] == 42 {
+		t.Errorf("rejected batch was partially applied on server")
+	}
+	if value, _ := clients[1].Get(0); value == 42 {
+		t.Errorf("rejected batch was not rolled back on client")
+	}
+
+	// the condition on the element deleted concurrently fails instead of being checked against its neighbour
+	srv = server.NewServer(10)
+	before := srv.Array()
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: &state.OpDelete{Position: 4}}); err != nil {
+		t.Errorf("could not delete pos 4: %v", err)
+	}
+	guard := &state.OpCompareAndSet{Position: 4, Expected: before[4], Value: 42}
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: guard}); !errors.Is(err, state.ErrElementDeleted) {
+		t.Errorf("expected condition on deleted element to fail, got %v", err)
+	}
+	if array := srv.Array(); len(array) != 9 || array[4] != before[5] {
+		t.Errorf("condition on deleted element was applied: %v", array)
+	}
+}
+
+func TestAtomicBatch(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	before := client.Array()
+	err := client.Batch([]state.Operation{
+		&state.OpInsert{Position: 0, Value: 1},
+		&state.OpMove{From: 0, To: 5},
+		&state.OpDelete{Position: 100},
+	})
+	var batchErr *state.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Errorf("expected batch error, got %v", err)
+	} else if batchErr.Index != 2 {
+		t.Errorf("expected operation #2 to fail, got #%d", batchErr.Index)
+	}
+	after := client.Array()
+	if len(after) != len(before) {
+		t.Errorf("failed batch changed array size from %d to %d", len(before), len(after))
+		return
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("failed batch changed pos %d from %d to %d", i, before[i], after[i])
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	clients := createClients(srv, 2)
+	for _, c := range clients {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	initial := srv.Array()
+	if err := clients[0].Update(5, 100); err != nil {
+		t.Errorf("could not update pos 5: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := clients[1].Insert(0, 200); err != nil {
+		t.Errorf("could not insert at pos 0: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := clients[1].Update(1, 300); err != nil {
+		t.Errorf("could not update pos 1: %v", err)
+	}
+	time.Sleep(time.Second)
+
+	if err := clients[0].Undo(); err != nil {
+		t.Errorf("could not undo: %v", err)
+	}
+	time.Sleep(time.Second)
+	array := srv.Array()
+	if array[6] != initial[5] {
+		t.Errorf("own update was not undone: expected %d at pos 6, got %d", initial[5], array[6])
+	}
+	if array[0] != 200 || array[1] != 300 {
+		t.Errorf("undo affected changes of another client: %v", array[:2])
+	}
+
+	if err := clients[0].Redo(); err != nil {
+		t.Errorf("could not redo: %v", err)
+	}
+	time.Sleep(time.Second)
+	for i, c := range clients {
+		if value, _ := c.Get(6); value != 100 {
+			t.Errorf("client %d: update was not redone: expected 100 at pos 6, got %d", i, value)
+		}
+	}
+	if err := clients[1].Redo(); err == nil {
+		t.Errorf("redo without undo succeeded")
+	}
+}
+
+func TestUndoConflicts(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	clients := createClients(srv, 2)
+	for _, c := range clients {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	if err := clients[0].Insert(3, 100); err != nil {
+		t.Errorf("could not insert at pos 3: %v", err)
+	}
+	time.Sleep(time.Second)
+	if err := clients[1].Delete(3); err != nil {
+		t.Errorf("could not delete pos 3: %v", err)
+	}
+	time.Sleep(time.Second)
+	array := srv.Array()
+	var conflictErr *state.RevertConflictError
+	if err := clients[0].Undo(); !errors.As(err, &conflictErr) {
+		t.Errorf("expected undo of insertion deleted by another client to conflict, got %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(array) {
+		t.Errorf("conflicting undo changed the array: expected %v, got %v", array, srv.Array())
+	}
+
+	if err := clients[0].Update(5, 200); err != nil {
+		t.Errorf("could not update pos 5: %v", err)
+	}
+	time.Sleep(time.Second)
+	if err := clients[1].Update(5, 300); err != nil {
+		t.Errorf("could not update pos 5: %v", err)
+	}
+	time.Sleep(time.Second)
+	for i := 0; i < 2; i++ {
+		// the entry stays on the stack after a failed undo
+		if err := clients[0].Undo(); !errors.As(err, &conflictErr) {
+			t.Errorf("expected undo of update overwritten by another client to conflict, got %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if value := srv.Array()[5]; value != 300 {
+		t.Errorf("undo overwrote update of another client: expected 300 at pos 5, got %d", value)
+	}
+}
+
+func TestArrayAt(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	var versions [][]int32
+	modifications := []func() error{
+		func() error { return client.Insert(3, 1) },
+		func() error { return client.Update(0, 2) },
+		func() error { return client.Add(0, 3) },
+		func() error { return client.Move(1, 8) },
+		func() error { return client.Delete(5) },
+	}
+	for _, modify := range modifications {
+		versions = append(versions, client.Array())
+		if err := modify(); err != nil {
+			t.Errorf("could not modify: %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	versions = append(versions, client.Array())
+	for version, expected := range versions {
+		array, err := client.ArrayAt(version)
+		if err != nil {
+			t.Errorf("could not get array at version %d: %v", version, err)
+			continue
+		}
+		if fmt.Sprint(array) != fmt.Sprint(expected) {
+			t.Errorf("array at version %d mismatch: expected %v, got %v", version, expected, array)
+		}
+	}
+	if _, err := client.ArrayAt(len(versions)); err == nil {
+		t.Errorf("got array at a version from the future")
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	directory := t.TempDir()
+	srv := server.NewServer(10)
+	if err := srv.PersistCheckpoints(directory); err != nil {
+		t.Errorf("could not persist checkpoints: %v", err)
+	}
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	expected := srv.Array()
+	if _, err := srv.CreateCheckpoint("before-import"); err != nil {
+		t.Errorf("could not create checkpoint: %v", err)
+	}
+	modifications := []func() error{
+		func() error { return client.Insert(3, 1) },
+		func() error { return client.Update(0, 2) },
+		func() error { return client.Delete(9) },
+		func() error { return client.Delete(8) },
+	}
+	for _, modify := range modifications {
+		if err := modify(); err != nil {
+			t.Errorf("could not modify: %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if checkpoints := srv.Checkpoints(); len(checkpoints) != 1 || checkpoints[0].Name != "before-import" || checkpoints[0].Version != 0 {
+		t.Errorf("unexpected checkpoints: %v", checkpoints)
+	}
+	version, err := srv.RevertToCheckpoint("before-import")
+	if err != nil {
+		t.Errorf("could not revert to checkpoint: %v", err)
+	}
+	if version != len(modifications)+1 {
+		t.Errorf("revert was not committed as a new version: %d", version)
+	}
+	time.Sleep(time.Second)
+	if fmt.Sprint(client.Array()) != fmt.Sprint(expected) {
+		t.Errorf("client did not converge to checkpoint: expected %v, got %v", expected, client.Array())
+	}
+	if _, err := srv.RevertToCheckpoint("unknown"); err == nil {
+		t.Errorf("reverted to unknown checkpoint")
+	}
+
+	restarted := server.NewServer(10)
+	if err := restarted.PersistCheckpoints(directory); err != nil {
+		t.Errorf("could not load persisted checkpoints: %v", err)
+	}
+	if checkpoints := restarted.Checkpoints(); len(checkpoints) != 1 || checkpoints[0].Name != "before-import" {
+		t.Errorf("checkpoints were not persisted: %v", checkpoints)
+	}
+	if _, err := restarted.RevertToCheckpoint("before-import"); err != nil {
+		t.Errorf("could not revert to persisted checkpoint: %v", err)
+	}
+	if fmt.Sprint(restarted.Array()) != fmt.Sprint(expected) {
+		t.Errorf("persisted checkpoint was not restored: expected %v, got %v", expected, restarted.Array())
+	}
+
+	// history is kept back to the checkpoint even when it outgrows its usual size
+	srv = server.NewServer(10)
+	expected = srv.Array()
+	if _, err := srv.CreateCheckpoint("initial"); err != nil {
+		t.Errorf("could not create checkpoint: %v", err)
+	}
+	for version := 0; version < 2000; version++ {
+		request := &event.ClientOperation{Version: version, Operation: &state.OpAdd{Position: version % 10, Delta: 1}}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Errorf("could not add at version %d: %v", version, err)
+			break
+		}
+	}
+	if _, err := srv.RevertToCheckpoint("initial"); err != nil {
+		t.Errorf("could not revert to checkpoint beyond usual history: %v", err)
+	}
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(expected) {
+		t.Errorf("checkpoint beyond usual history was not restored: expected %v, got %v", expected, srv.Array())
+	}
+	// the deleted checkpoint no longer keeps history
+	if err := srv.DeleteCheckpoint("initial"); err != nil {
+		t.Errorf("could not delete checkpoint: %v", err)
+	}
+	if _, _, err := srv.History(0); !errors.Is(err, state.ErrHistoryTrimmed) {
+		t.Errorf("history was kept after the checkpoint was deleted: %v", err)
+	}
+	if err := srv.DeleteCheckpoint("initial"); err == nil {
+		t.Errorf("deleted checkpoint twice")
+	}
+
+	// checkpoints older than the retention limit are restored from their files
+	srv = server.NewServer(10)
+	if err := srv.PersistCheckpoints(t.TempDir()); err != nil {
+		t.Errorf("could not persist checkpoints: %v", err)
+	}
+	srv.SetRetentionLimit(1500)
+	expected = srv.Array()
+	if _, err := srv.CreateCheckpoint("initial"); err != nil {
+		t.Errorf("could not create checkpoint: %v", err)
+	}
+	for version := 0; version < 2000; version++ {
+		request := &event.ClientOperation{Version: version, Operation: &state.OpAdd{Position: version % 10, Delta: 1}}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Errorf("could not add at version %d: %v", version, err)
+			break
+		}
+	}
+	if _, _, err := srv.History(0); !errors.Is(err, state.ErrHistoryTrimmed) {
+		t.Errorf("history beyond the retention limit was kept: %v", err)
+	}
+	if _, err := srv.RevertToCheckpoint("initial"); err != nil {
+		t.Errorf("could not revert to checkpoint beyond the retention limit: %v", err)
+	}
+	if fmt.Sprint(srv.Array()) != fmt.Sprint(expected) {
+		t.Errorf("checkpoint beyond the retention limit was not restored: expected %v, got %v", expected, srv.Array())
+	}
+}
+
+func TestRevertOperation(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	initial := srv.Array()
+	modifications := []func() error{
+		func() error { return client.Update(4, 1) },
+		func() error { return client.Insert(0, 2) },
+		func() error { return client.Update(2, 3) },
+		func() error { return client.Delete(2) },
+	}
+	for _, modify := range modifications {
+		if err := modify(); err != nil {
+			t.Errorf("could not modify: %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if _, err := srv.RevertOperation(0); err != nil {
+		t.Errorf("could not revert update at version 0: %v", err)
+	}
+	time.Sleep(time.Second)
+	if value, _ := client.Get(4); value != initial[4] {
+		t.Errorf("update was not reverted: expected %d at pos 4, got %d", initial[4], value)
+	}
+	if value, _ := client.Get(0); value != 2 {
+		t.Errorf("later insert was lost: expected 2 at pos 0, got %d", value)
+	}
+
+	_, err := srv.RevertOperation(2)
+	var conflictErr *state.RevertConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Errorf("expected conflict reverting update of deleted element, got %v", err)
+	} else if conflictErr.ConflictingVersion != 3 {
+		t.Errorf("expected conflict with version 3, got %d", conflictErr.ConflictingVersion)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	clients := createClients(srv, 2)
+	for _, c := range clients {
+		if err := c.Initialize(); err != nil {
+			t.Errorf("could not initialize client: %v", err)
+		}
+	}
+	modifications := []func() error{
+		func() error { return clients[0].Update(5, 1) },
+		func() error { return clients[1].Insert(0, 2) },
+		func() error { return clients[1].Delete(3) },
+		func() error { return clients[0].Move(0, 9) },
+	}
+	for _, modify := range modifications {
+		if err := modify(); err != nil {
+			t.Errorf("could not modify: %v", err)
+		}
+		time.Sleep(time.Millisecond * 600)
+	}
+	version, blame, err := clients[0].Blame(0, 10)
+	if err != nil {
+		t.Errorf("could not blame: %v", err)
+		return
+	}
+	if version != len(modifications) {
+		t.Errorf("unexpected blame version: %d", version)
+	}
+	for pos, entry := range blame {
+		switch pos {
+		case 4:
+			if entry.Version != 0 || entry.ClientID != clients[0].ID() {
+				t.Errorf("update was not blamed at pos 4: %+v", entry)
+			}
+		case 9:
+			if entry.Version != 1 || entry.ClientID != clients[1].ID() {
+				t.Errorf("moved insert was not blamed at pos 9: %+v", entry)
+			}
+		default:
+			if entry.Version != -1 {
+				t.Errorf("initial element at pos %d was blamed: %+v", pos, entry)
+			}
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	srv := server.NewServer(10)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Insert(0, int32(i)); err != nil {
+			t.Errorf("could not insert: %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	operations, metadata, err := srv.History(0)
+	if err != nil {
+		t.Errorf("could not get history: %v", err)
+		return
+	}
+	if len(operations) != 3 || len(metadata) != 3 {
+		t.Errorf("unexpected history length: %d operations, %d metadata", len(operations), len(metadata))
+		return
+	}
+	for i, meta := range metadata {
+		if meta.ClientID != client.ID() || meta.OperationID != uint64(i+1) || meta.Version != i || meta.Timestamp.IsZero() {
+			t.Errorf("unexpected metadata of operation %d: %v", i, meta)
+		}
+	}
+}
+
+func TestMetadataWithFullHistory(t *testing.T) {
+	srv := server.NewServer(10)
+	for version := 0; version < 1000; version++ {
+		request := &event.ClientOperation{Version: version, Operation: &state.OpAdd{Position: 0, Delta: 1}}
+		if _, err := srv.Handler.Handle(request); err != nil {
+			t.Fatalf("could not add at version %d: %v", version, err)
+		}
+	}
+	// the history is full, so committing the operation pushes the one at the version of the operation out of it
+	response, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: &state.OpAdd{Position: 1, Delta: 1}})
+	if err != nil {
+		t.Fatalf("could not add at the oldest version: %v", err)
+	}
+	metadata := response.(*event.ServerOperationResponse).Metadata
+	if len(metadata) != 1001 || metadata[0].Version != 0 || metadata[1000].Version != 1000 {
+		t.Errorf("unexpected metadata of %d operations since the oldest version", len(metadata))
+	}
+}
+
+func TestIdempotentRetry(t *testing.T) {
+	srv := server.NewServer(10)
+	request := &event.ClientOperation{
+		Version:   0,
+		Operation: &state.OpAdd{Position: 2, Delta: 5},
+		Metadata:  state.Metadata{ClientID: "retrying", OperationID: 1},
+	}
+	initial := srv.Array()[2]
+	first, err := srv.Handler.Handle(request)
+	if err != nil {
+		t.Errorf("could not perform operation: %v", err)
+	}
+	retry, err := srv.Handler.Handle(request)
+	if err != nil {
+		t.Errorf("could not retry operation: %v", err)
+	}
+	if value := srv.Array()[2]; value != initial+5 {
+		t.Errorf("retried operation was applied twice: expected %d, got %d", initial+5, value)
+	}
+	if fmt.Sprint(first) != fmt.Sprint(retry) {
+		t.Errorf("retry got different result: %v and %v", first, retry)
+	}
+	request.Metadata.OperationID = 2
+	if _, err = srv.Handler.Handle(request); err != nil {
+		t.Errorf("could not perform next operation: %v", err)
+	}
+	if value := srv.Array()[2]; value != initial+10 {
+		t.Errorf("next operation was deduplicated: expected %d, got %d", initial+10, value)
+	}
+}
+
+func TestViewport(t *testing.T) {
+	srv := server.NewServer(100)
+	srv.Initialize()
+	full := client.NewClient(srv)
+	if err := full.Initialize(); err != nil {
+		t.Errorf("could not initialize client: %v", err)
+	}
+	viewport := client.NewViewportClient(srv)
+	if err := viewport.Subscribe(10, 20); err != nil {
+		t.Errorf("could not subscribe to viewport: %v", err)
+	}
+	modifications := []func() error{
+		func() error { return full.Insert(0, 1) },
+		func() error { return full.Update(15, 2) },
+		func() error { return full.Delete(50) },
+		func() error { return full.Move(3, 60) },
+		func() error { return viewport.Update(12, 3) },
+		func() error { return viewport.Insert(20, 4) },
+		func() error { return full.Move(14, 90) },
+	}
+	for _, modify := range modifications {
+		if err := modify(); err != nil {
+			t.Errorf("could not modify: %v", err)
+		}
+		time.Sleep(time.Millisecond * 600)
+	}
+	from, to := viewport.Range()
+	if from != 10 || to != 20 {
+		t.Errorf("unexpected viewport range: [%d, %d)", from, to)
+	}
+	expected := srv.Array()[from:to]
+	if fmt.Sprint(viewport.Array()) != fmt.Sprint(expected) {
+		t.Errorf("viewport mismatch: expected %v, got %v", expected, viewport.Array())
+	}
+	if _, err := viewport.Get(25); err == nil {
+		t.Errorf("got value out of viewport")
+	}
+}
+
+func TestRangeAggregates(t *testing.T) {
+	srv := server.NewServer(10_000)
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Fatalf("could not initialize client: %v", err)
+	}
+	if err := client.Update(5000, math.MinInt32); err != nil {
+		t.Errorf("could not update pos 5000: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	array := client.Array()
+	for _, r := range [][2]int{{0, 10_000}, {17, 4321}, {4999, 5001}, {9990, 10_000}} {
+		from, to := r[0], r[1]
+		sum, min, max := int64(0), int32(math.MaxInt32), int32(math.MinInt32)
+		for _, value := range array[from:to] {
+			sum += int64(value)
+			if value < min {
+				min = value
+			}
+			if value > max {
+				max = value
+			}
+		}
+		if actual, err := client.RangeSum(from, to); err != nil || actual != sum {
+			t.Errorf("sum of [%d, %d) is %d (%v) instead of %d", from, to, actual, err, sum)
+		}
+		if actual, err := client.RangeMin(from, to); err != nil || actual != min {
+			t.Errorf("min of [%d, %d) is %d (%v) instead of %d", from, to, actual, err, min)
+		}
+		if actual, err := client.RangeMax(from, to); err != nil || actual != max {
+			t.Errorf("max of [%d, %d) is %d (%v) instead of %d", from, to, actual, err, max)
+		}
+	}
+	if _, err := client.RangeMin(3, 3); err == nil {
+		t.Errorf("min of an empty range was computed")
+	}
+}
+
+func TestValueIndex(t *testing.T) {
+	srv := server.NewServer(5_000)
+	srv.EnableIndex()
+	srv.Initialize()
+	client := client.NewClient(srv)
+	if err := client.Initialize(); err != nil {
+		t.Fatalf("could not initialize client: %v", err)
+	}
+	client.EnableIndex()
+	random := rand.New(rand.NewSource(47))
+	// few distinct values, so that they repeat across the array and shift around with every insert and delete
+	for i := 0; i < 3000; i++ {
+		size, value := client.Size(), random.Int31n(50)
+		var err error
+		switch random.Intn(4) {
+		case 0:
+			err = client.Insert(random.Intn(size+1), value)
+		case 1:
+			err = client.Delete(random.Intn(size))
+		case 2:
+			err = client.Update(random.Intn(size), value)
+		default:
+			err = client.Move(random.Intn(size), random.Intn(size))
+		}
+		if err != nil {
+			t.Fatalf("could not modify: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	check := func(name string, array []int32, indexOf func(int32) int, countOf func(int32) int, contains func(int32) bool) {
+		values := []int32{-1, array[0], array[len(array)/2], array[len(array)-1]}
+		for value := int32(0); value < 50; value++ {
+			values = append(values, value)
+		}
+		for _, value := range values {
+			first, count := -1, 0
+			for pos, element := range array {
+				if element == value {
+					if first < 0 {
+						first = pos
+					}
+					count++
+				}
+			}
+			if actual := indexOf(value); actual != first {
+				t.Errorf("%s: index of %d is %d instead of %d", name, value, actual, first)
+			}
+			if actual := countOf(value); actual != count {
+				t.Errorf("%s: count of %d is %d instead of %d", name, value, actual, count)
+			}
+			if contains(value) != (count > 0) {
+				t.Errorf("%s: containment of %d is wrong", name, value)
+			}
+		}
+	}
+	check("client", client.Array(), client.IndexOf, client.CountOf, client.Contains)
+	check("server", srv.Array(), srv.IndexOf, srv.CountOf, srv.Contains)
+}
+
+func TestSortedDocument(t *testing.T) {
+	srv := server.NewServer(1_000)
+	if err := srv.EnableSortedMode(); err != nil {
+		t.Fatalf("could not enable sorted mode: %v", err)
+	}
+	srv.Initialize()
+	clients := createClients(srv, 10)
+	for _, client := range clients {
+		if err := client.Initialize(); err != nil {
+			t.Fatalf("could not initialize client: %v", err)
+		}
+		client.SetRejectionHandler(func(op state.Operation, err error) {})
+	}
+	wg := sync.WaitGroup{}
+	for i, client := range clients {
+		i, client := i, client
+		random := rand.New(rand.NewSource(int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				var err error
+				switch size := client.Size(); random.Intn(4) {
+				case 0:
+					err = client.InsertSorted(int32(random.Uint32()))
+				case 1:
+					err = client.Update(random.Intn(size), int32(random.Uint32()))
+				case 2:
+					err = client.Delete(random.Intn(size))
+				default:
+					// positional inserts are accepted only where they keep the order
+					err = client.Insert(random.Intn(size+1), int32(random.Uint32()))
+				}
+				if err != nil && !errors.Is(err, state.ErrOrderViolated) {
+					t.Errorf("could not modify on client %d: %v", i, err)
+					return
+				}
+				time.Sleep(time.Millisecond * 5)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Second)
+
+	expected := srv.Array()
+	for i := 1; i < len(expected); i++ {
+		if expected[i-1] > expected[i] {
+			t.Fatalf("server array is not sorted at %d: %d > %d", i, expected[i-1], expected[i])
+		}
+	}
+	for i, client := range clients {
+		if actual := client.Array(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("client %d differs from the server", i)
+		}
+	}
+	for _, value := range []int32{expected[0], expected[len(expected)/2], expected[len(expected)-1], math.MinInt32, math.MaxInt32} {
+		pos, found := clients[0].Search(value)
+		expectedPos := sort.Search(len(expected), func(i int) bool { return expected[i] >= value })
+		if pos != expectedPos || found != (pos < len(expected) && expected[pos] == value) {
+			t.Errorf("search of %d gave %d, %v instead of %d", value, pos, found, expectedPos)
+		}
+	}
+	if err := clients[0].Insert(0, math.MaxInt32); !errors.Is(err, state.ErrOrderViolated) {
+		t.Errorf("insert breaking the order was not rejected: %v", err)
+	}
+
+	// the update of the element deleted concurrently is dropped instead of overwriting its neighbour
+	srv = server.NewServer(10)
+	if err := srv.EnableSortedMode(); err != nil {
+		t.Fatalf("could not enable sorted mode: %v", err)
+	}
+	before := srv.Array()
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: &state.OpDelete{Position: 4}}); err != nil {
+		t.Errorf("could not delete pos 4: %v", err)
+	}
+	update := &state.OpUpdateSorted{Position: 4, To: 4, Value: math.MaxInt32, PreviousValue: before[4]}
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: update}); err != nil {
+		t.Errorf("could not update pos 4: %v", err)
+	}
+	expected = append(append([]int32(nil), before[:4]...), before[5:]...)
+	if array := srv.Array(); fmt.Sprint(array) != fmt.Sprint(expected) {
+		t.Errorf("update of deleted element was applied: %v instead of %v", array, expected)
+	}
+}
+
+func TestGenericDocument(t *testing.T) {
+	srv := server.NewServerOf(util.StringCodec, util.BackendRope, []string{"alpha", "beta", "gamma"})
+	if err := srv.PersistCheckpoints(t.TempDir()); err != nil {
+		t.Fatalf("could not persist checkpoints: %v", err)
+	}
+	srv.Initialize()
+	if _, err := srv.CreateCheckpoint("initial"); err != nil {
+		t.Fatalf("could not create checkpoint: %v", err)
+	}
+	clients := make([]*client.ClientOf[string], 5)
+	for i := range clients {
+		clients[i] = client.NewClientOf(util.StringCodec, srv)
+		if err := clients[i].Initialize(); err != nil {
+			t.Fatalf("could not initialize client: %v", err)
+		}
+		clients[i].SetRejectionHandler(func(op state.Operation, err error) {})
+	}
+	if err := clients[0].Add(0, 1); err == nil {
+		t.Errorf("addition to a string was not rejected")
+	}
+	if sum, err := clients[0].RangeSum(0, clients[0].Size()); err == nil {
+		t.Errorf("sum of strings was not rejected: %d", sum)
+	}
+	wg := sync.WaitGroup{}
+	for i, c := range clients {
+		i, c := i, c
+		random := rand.New(rand.NewSource(int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var err error
+				word := fmt.Sprintf("word-%d-%d", i, j)
+				switch size := c.Size(); {
+				case size == 0:
+					err = c.Insert(0, word)
+				case random.Intn(4) == 0:
+					err = c.Update(random.Intn(size), word)
+				case random.Intn(3) == 0:
+					err = c.Move(random.Intn(size), random.Intn(size))
+				case random.Intn(2) == 0:
+					err = c.Delete(random.Intn(size))
+				default:
+					err = c.Insert(random.Intn(size+1), word)
+				}
+				if err != nil {
+					t.Errorf("could not modify on client %d: %v", i, err)
+					return
+				}
+				time.Sleep(time.Millisecond * 5)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Second)
+
+	expected := srv.Array()
+	for i, c := range clients {
+		if actual := c.Array(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("client %d differs from the server: %v instead of %v", i, actual, expected)
+		}
+	}
+	if _, err := srv.RevertToCheckpoint("initial"); err != nil {
+		t.Fatalf("could not revert to checkpoint: %v", err)
+	}
+	if array := srv.Array(); fmt.Sprint(array) != "[alpha beta gamma]" {
+		t.Errorf("checkpoint was restored as %v", array)
+	}
+
+	sorted := server.NewServerOf(util.Int64Codec, util.BackendBlocked, []int64{-1 << 40, 0, 1 << 40})
+	if err := sorted.EnableSortedMode(); err != nil {
+		t.Fatalf("could not enable sorted mode: %v", err)
+	}
+	sorted.Initialize()
+	c := client.NewClientOf(util.Int64Codec, sorted)
+	if err := c.Initialize(); err != nil {
+		t.Fatalf("could not initialize client: %v", err)
+	}
+	if err := c.InsertSorted(1 << 35); err != nil {
+		t.Fatalf("could not insert by value: %v", err)
+	}
+	if pos, found := c.Search(1 << 35); pos != 2 || !found {
+		t.Errorf("search gave %d, %v instead of 2, true", pos, found)
+	}
+	if max, err := c.RangeMax(0, c.Size()); err != nil || max != 1<<40 {
+		t.Errorf("range max is %d instead of %d: %v", max, int64(1<<40), err)
+	}
+}
+
+func TestTextDocument(t *testing.T) {
+	srv := server.NewTextServer("0123456789")
+	writer, reader := client.NewTextClient(srv), client.NewTextClient(srv)
+	for _, c := range []*client.TextClient{writer, reader} {
+		if err := c.Initialize(); err != nil {
+			t.Fatalf("could not initialize client: %v", err)
+		}
+	}
+	// without the broadcaster the deletion is made before its author learns about the insertion into the range
+	if err := reader.InsertText(4, "ab"); err != nil {
+		t.Fatalf("could not insert text: %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if err := writer.DeleteText(2, 5); err != nil {
+		t.Fatalf("could not delete text: %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if text := writer.Text(); text != "01ab789" {
+		t.Errorf("concurrent insertion into the deleted range gave %q", text)
+	}
+	if err := writer.Undo(); err != nil {
+		t.Fatalf("could not undo deletion: %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if text := writer.Text(); text != "0123ab456789" {
+		t.Errorf("undo of the deletion gave %q", text)
+	}
+
+	srv = server.NewTextServer("Привет, мир! 👋")
+	srv.Initialize()
+	clients := make([]*client.TextClient, 5)
+	for i := range clients {
+		clients[i] = client.NewTextClient(srv)
+		if err := clients[i].Initialize(); err != nil {
+			t.Fatalf("could not initialize client: %v", err)
+		}
+	}
+	if text, err := clients[0].TextRange(8, 11); err != nil || text != "мир" {
+		t.Errorf("runes [8, 11) are %q instead of \"мир\": %v", text, err)
+	}
+	if err := clients[0].InsertText(0, "\xff"); err == nil {
+		t.Errorf("invalid UTF-8 was inserted")
+	}
+	paste := []rune(strings.Repeat("большая вставка ", 20_000))
+	wg := sync.WaitGroup{}
+	for i, c := range clients {
+		i, c := i, c
+		random := rand.New(rand.NewSource(int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var err error
+				switch size := c.Size(); {
+				case i == 0 && j == 50:
+					err = c.InsertText(random.Intn(size+1), string(paste))
+				case size > 0 && random.Intn(3) == 0:
+					pos := random.Intn(size)
+					err = c.DeleteText(pos, random.Intn(size-pos)%10+1)
+				case size > 0 && random.Intn(3) == 0:
+					pos := random.Intn(size)
+					err = c.ReplaceText(pos, random.Intn(size-pos)%5, fmt.Sprintf("«%d»", j))
+				default:
+					err = c.InsertText(random.Intn(size+1), fmt.Sprintf("ü%d-%d✓", i, j))
+				}
+				if err != nil {
+					t.Errorf("could not edit on client %d: %v", i, err)
+					return
+				}
+				time.Sleep(time.Millisecond * 5)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Second)
+
+	expected := string(srv.Array())
+	if len([]rune(expected)) < len(paste) {
+		t.Errorf("the paste is lost: there are only %d runes left", len([]rune(expected)))
+	}
+	for i, c := range clients {
+		if c.Text() != expected {
+			t.Errorf("client %d differs from the server", i)
+		}
+	}
+
+	// operations on the elements of the range deleted concurrently do nothing, conditions on them fail
+	srv = server.NewServer(10)
+	before := srv.Array()
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: &state.OpDeleteText{Position: 2, Length: 5}}); err != nil {
+		t.Fatalf("could not delete range [2, 7): %v", err)
+	}
+	for _, op := range []state.Operation{
+		&state.OpUpdate{Position: 4, Value: -1, PreviousValue: before[4]},
+		&state.OpDelete{Position: 2, PreviousValue: before[2]},
+		&state.OpAdd{Position: 6, Delta: 1},
+		&state.OpUpdateSorted{Position: 5, To: 5, Value: -1, PreviousValue: before[5]},
+	} {
+		if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: op}); err != nil {
+			t.Errorf("could not perform %v: %v", op, err)
+		}
+	}
+	guard := &state.OpCompareAndSet{Position: 3, Expected: before[3], Value: -1}
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: guard}); !errors.Is(err, state.ErrElementDeleted) {
+		t.Errorf("expected condition on deleted element to fail, got %v", err)
+	}
+	if _, err := srv.Handler.Handle(&event.ClientOperation{Version: 0, Operation: &state.OpUpdate{Position: 8, Value: -1, PreviousValue: before[8]}}); err != nil {
+		t.Errorf("could not update pos 8: %v", err)
+	}
+	remaining := append(append([]int32(nil), before[:2]...), before[7:]...)
+	remaining[3] = -1
+	if array := srv.Array(); fmt.Sprint(array) != fmt.Sprint(remaining) {
+		t.Errorf("operations on deleted elements were applied: %v instead of %v", array, remaining)
+	}
+}
@@ -8,13 +8,13 @@ import (
 	"time"
 )
 
-type broadcaster struct {
-	server        *Server
+type broadcaster[T comparable] struct {
+	server        *ServerOf[T]
 	latestVersion int
 }
 
-func initBroadcaster(ctx context.Context, server *Server, interval time.Duration) {
-	b := &broadcaster{server: server, latestVersion: 0}
+func initBroadcaster[T comparable](ctx context.Context, server *ServerOf[T], interval time.Duration) {
+	b := &broadcaster[T]{server: server, latestVersion: 0}
 	ticker := time.NewTicker(interval)
 	go func() {
 		for {
@@ -30,9 +30,9 @@ func initBroadcaster(ctx context.Context, server *Server, interval time.Duration
 	}()
 }
 
-func (b *broadcaster) broadcast() error {
+func (b *broadcaster[T]) broadcast() error {
 	version := b.latestVersion
-	operations, err := b.server.versioner.GetOperationsSince(version)
+	operations, metadata, err := b.server.versioner.GetHistorySince(version)
 	if err != nil {
 		return err
 	}
@@ -41,7 +41,11 @@ func (b *broadcaster) broadcast() error {
 	}
 	b.latestVersion = version + len(operations)
 	return b.server.ProcessConnections(func(conn *connection.ClientConnection) error {
-		conn.Send(&event.ServerDiff{Version: version, Diff: operations})
+		if conn.Viewport {
+			conn.Send(&event.ServerDiffAvailable{Version: b.latestVersion})
+		} else {
+			conn.Send(&event.ServerDiff{Version: version, Diff: operations, Metadata: metadata})
+		}
 		return nil
 	})
 }
@@ -3,27 +3,135 @@ package server
 import (
 	"fmt"
 	"github.com/RinesThaix/homeTask/event"
+	"github.com/RinesThaix/homeTask/state"
 )
 
-type Handler struct {
-	server *Server
+type HandlerOf[T comparable] struct {
+	server *ServerOf[T]
 }
 
-func (h *Handler) Handle(rawEvent event.ClientEvent) (event.Event, error) {
+type Handler = HandlerOf[int32]
+
+func (h *HandlerOf[T]) Handle(rawEvent event.ClientEvent) (event.Event, error) {
 	switch e := rawEvent.(type) {
 	case *event.ClientInitialize:
 		version, state := h.server.versioner.GetCurrentState()
-		return &event.ServerInitializationResponse{Array: state, Version: version}, nil
+		return &event.ServerInitializationResponseOf[T]{Array: state, Version: version, Sorted: h.server.versioner.State.Sorted()}, nil
+	case *event.ClientStartInitialization:
+		version, snapshot := h.server.versioner.Snapshot()
+		id, size := 0, snapshot.Size()
+		if size == 0 {
+			snapshot.Release()
+		} else {
+			id, _ = h.server.snapshots.create(version, snapshot)
+		}
+		return &event.ServerInitializationStart{Session: id, Version: version, Size: size, Sorted: h.server.versioner.State.Sorted()}, nil
+	case *event.ClientAskForChunk:
+		snap, err := h.server.snapshots.get(e.Session)
+		if err != nil {
+			return nil, err
+		}
+		size := snap.array.Size()
+		if e.Offset < 0 || e.Offset >= size || e.Size <= 0 {
+			return nil, fmt.Errorf("invalid chunk of %d elements at %d, whilst there are %d", e.Size, e.Offset, size)
+		}
+		to := e.Offset + e.Size
+		if e.Size > maxChunkSize {
+			to = e.Offset + maxChunkSize
+		}
+		if to > size {
+			to = size
+		}
+		array, err := snap.array.Range(e.Offset, to)
+		if err != nil {
+			return nil, err
+		}
+		return &event.ServerChunkOf[T]{Offset: e.Offset, Array: array}, nil
+	case *event.ClientReleaseSession:
+		h.server.snapshots.delete(e.Session)
+		return &event.ServerSessionReleased{}, nil
 	case *event.ClientAskForDiff:
+		diff, metadata, err := h.server.versioner.GetHistorySince(e.Version)
+		if err != nil {
+			return nil, err
+		}
+		return &event.ServerDiffResponse{Diff: diff, Metadata: metadata}, nil
+	case *event.ClientAskForState:
+		array, err := h.server.versioner.StateAt(e.Version)
+		if err != nil {
+			return nil, err
+		}
+		return &event.ServerStateResponseOf[T]{Version: e.Version, Array: array}, nil
+	case *event.ClientAskForBlame:
+		version, blame, err := h.server.Blame(e.From, e.To)
+		if err != nil {
+			return nil, err
+		}
+		return &event.ServerBlameResponse{Version: version, Blame: blame}, nil
+	case *event.ClientRepairStart:
+		if e.LeafSize <= 0 {
+			return nil, fmt.Errorf("leaf size must be positive: %d", e.LeafSize)
+		}
+		version, snapshot := h.server.versioner.Snapshot()
+		id, snap := h.server.snapshots.create(version, snapshot)
+		snap.tree = snapshot.MerkleTree(e.LeafSize)
+		return &event.ServerRepairStart{Session: id, Version: version, Size: snapshot.Size(), Depth: snap.tree.Depth(), Root: snap.tree.Root()}, nil
+	case *event.ClientRepairNodes:
+		snap, err := h.server.snapshots.get(e.Session)
+		if err != nil {
+			return nil, err
+		}
+		if snap.tree == nil || e.Level < 0 || e.Level >= snap.tree.Depth() {
+			return nil, fmt.Errorf("there is no level %d in repair session %d", e.Level, e.Session)
+		}
+		hashes := make([]uint64, len(e.Indices))
+		for i, index := range e.Indices {
+			if index < 0 || index >= snap.tree.Width(e.Level) {
+				return nil, fmt.Errorf("there is no node %d on level %d", index, e.Level)
+			}
+			hashes[i] = snap.tree.Node(e.Level, index)
+		}
+		return &event.ServerRepairNodes{Hashes: hashes}, nil
+	case *event.ClientRepairLeaves:
+		snap, err := h.server.snapshots.get(e.Session)
+		if err != nil {
+			return nil, err
+		}
+		if snap.tree == nil {
+			return nil, fmt.Errorf("session %d is not a repair one", e.Session)
+		}
+		leaves := make([][]T, len(e.Indices))
+		for i, index := range e.Indices {
+			if index < 0 || index >= snap.tree.Width(snap.tree.Depth()-1) {
+				return nil, fmt.Errorf("there is no leaf %d", index)
+			}
+			from, to := snap.tree.Leaf(index)
+			if leaves[i], err = snap.array.Range(from, to); err != nil {
+				return nil, err
+			}
+		}
+		return &event.ServerRepairLeavesOf[T]{Leaves: leaves}, nil
+	case *event.ClientSubscribeViewport:
+		version, array, err := h.server.versioner.GetRange(e.From, e.To)
+		if err != nil {
+			return nil, err
+		}
+		return &event.ServerViewportResponseOf[T]{Version: version, Viewport: state.ViewportOf[T]{From: e.From, Size: len(array)}, Array: array}, nil
+	case *event.ClientAskForViewportDiffOf[T]:
 		diff, err := h.server.versioner.GetOperationsSince(e.Version)
 		if err != nil {
 			return nil, err
 		}
-		return &event.ServerDiffResponse{Diff: diff}, nil
+		viewport := e.Viewport
+		projections := make([]state.Projection, len(diff))
+		for i, op := range diff {
+			projections[i] = viewport.Project(op)
+		}
+		return &event.ServerViewportDiffResponse{Version: e.Version + len(diff), Projections: projections}, nil
 	case *event.ClientOperation:
 		op := e.Operation.Copy() // because we don't really have any networking and (de)serialization, this exact field will be used on client for rollback actions
-		rollback, diff, err := h.server.versioner.ProcessOperation(e.Version, op)
-		return &event.ServerOperationResponse{Rollback: rollback, Diff: diff}, err
+		rollback, diff, metadata, err := h.server.versioner.ProcessOperation(e.Version, op, e.Metadata)
+		return &event.ServerOperationResponse{Rollback: rollback, Diff: diff, Metadata: metadata}, err
 	default:
 		return nil, fmt.Errorf("unknown event: %T", e)
 	}
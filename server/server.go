@@ -2,44 +2,122 @@ package server
 
 import (
 	"context"
+	"errors"
 	"github.com/RinesThaix/homeTask/connection"
 	"github.com/RinesThaix/homeTask/state"
+	"github.com/RinesThaix/homeTask/util"
 	"math/rand"
 	"sort"
 	"sync"
 	"time"
 )
 
-type Server struct {
-	Handler     *Handler
-	versioner   *state.Versioner
+// ServerOf keeps the document of elements of type T
+type ServerOf[T comparable] struct {
+	Handler     *HandlerOf[T]
+	versioner   *state.VersionerOf[T]
+	checkpoints *state.CheckpointStoreOf[T]
+	snapshots   *snapshots[T]
 
 	connectionID     int
 	connections      map[int]*connection.ClientConnection
 	connectionsMutex sync.Mutex
 }
 
+type Server = ServerOf[int32]
+
+// checkpointsSuffix is appended to the path of the document stored on disk to get the directory of its checkpoints
+const checkpointsSuffix = ".checkpoints"
+
+// NewServer creates the server keeping the document in memory. Checkpoints are not persisted unless
+// PersistCheckpoints is called: they are restored through history then, so the ones older than the retention limit
+// of history (see state.VersionerOf.SetRetentionLimit) could not be reverted to.
 func NewServer(initialArraySize int) *Server {
-	srv := &Server{}
-	srv.Handler = &Handler{server: srv}
-	srv.versioner = state.NewVersioner(state.NewState(srv.initArray(initialArraySize)), 1000)
+	return NewServerWithBackend(initialArraySize, util.BackendBlocked)
+}
+
+// NewServerWithBackend creates the server keeping the document in the sequence of the given backend
+func NewServerWithBackend(initialArraySize int, backend util.Backend) *Server {
+	return newServer(state.NewStateOf(backend, initArray(initialArraySize)))
+}
+
+// NewServerOnDisk creates the server keeping the document in the new file at the path with cacheSize blocks of it
+// cached in memory. Modified blocks are written to the file on every checkpoint and once the server is closed,
+// so that the document could be opened again with OpenServerOnDisk. Checkpoints are persisted into the directory
+// next to the file.
+func NewServerOnDisk(initialArraySize int, path string, cacheSize int) (*Server, error) {
+	return NewServerOnDiskOf(util.Int32Codec, initArray(initialArraySize), path, cacheSize)
+}
+
+// OpenServerOnDisk creates the server keeping the document stored in the file at the path by a server created with
+// NewServerOnDisk, as of its last checkpoint or close. Its checkpoints are loaded as well.
+func OpenServerOnDisk(path string, cacheSize int) (*Server, error) {
+	return OpenServerOnDiskOf(util.Int32Codec, path, cacheSize)
+}
+
+// NewServerOf creates the server keeping the document of elements of type T, starting with the initial array,
+// in the sequence of the given backend
+func NewServerOf[T comparable](codec util.Codec[T], backend util.Backend, initialArray []T) *ServerOf[T] {
+	return newServer(state.NewStateWithCodec(codec, backend, initialArray))
+}
+
+// NewServerOnDiskOf creates the server keeping the document of elements of type T in the file at the path,
+// see NewServerOnDisk; the codec must encode all the elements with the same number of bytes
+func NewServerOnDiskOf[T comparable](codec util.Codec[T], initialArray []T, path string, cacheSize int) (*ServerOf[T], error) {
+	array, err := util.NewDiskArrayOf(codec, path, initialArray, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return newServerOnDisk(array, path)
+}
+
+// OpenServerOnDiskOf opens the document of elements of type T stored in the file at the path, see OpenServerOnDisk
+func OpenServerOnDiskOf[T comparable](codec util.Codec[T], path string, cacheSize int) (*ServerOf[T], error) {
+	array, err := util.OpenDiskArrayOf(codec, path, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return newServerOnDisk(array, path)
+}
+
+func newServerOnDisk[T comparable](array *util.DiskArrayOf[T], path string) (*ServerOf[T], error) {
+	srv := newServer(state.NewStateFrom(array))
+	if err := srv.PersistCheckpoints(path + checkpointsSuffix); err != nil {
+		array.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// NewTextServer creates the server keeping the text document, whose elements are the runes of the text.
+// The document is kept in a rope, so that long pieces of text are inserted and deleted at once.
+func NewTextServer(text string) *Server {
+	return NewServerOf(util.Int32Codec, util.BackendRope, []rune(text))
+}
+
+func newServer[T comparable](document *state.StateOf[T]) *ServerOf[T] {
+	srv := &ServerOf[T]{}
+	srv.Handler = &HandlerOf[T]{server: srv}
+	srv.versioner = state.NewVersioner(document, 1000)
+	srv.checkpoints, _ = state.NewCheckpointStoreWithCodec(document.Codec(), "") // in-memory store never fails
+	srv.snapshots = newSnapshots[T]()
 	srv.connections = make(map[int]*connection.ClientConnection)
 	srv.connectionsMutex = sync.Mutex{}
 	return srv
 }
 
-func (s *Server) Initialize() {
+func (s *ServerOf[T]) Initialize() {
 	initBroadcaster(context.Background(), s, time.Millisecond * 500)
 }
 
-func (s *Server) OnClientConnected(conn *connection.ClientConnection) {
+func (s *ServerOf[T]) OnClientConnected(conn *connection.ClientConnection) {
 	s.connectionsMutex.Lock()
 	defer s.connectionsMutex.Unlock()
 	s.connectionID++
 	s.connections[s.connectionID] = conn
 }
 
-func (s *Server) OnClientDisconnected(conn *connection.ClientConnection) {
+func (s *ServerOf[T]) OnClientDisconnected(conn *connection.ClientConnection) {
 	// not storing client id anywhere except for the server itself, so just iterating over all values
 	s.connectionsMutex.Lock()
 	defer s.connectionsMutex.Unlock()
@@ -51,7 +129,7 @@ func (s *Server) OnClientDisconnected(conn *connection.ClientConnection) {
 	}
 }
 
-func (s *Server) ProcessConnections(execution func(conn *connection.ClientConnection) error) error {
+func (s *ServerOf[T]) ProcessConnections(execution func(conn *connection.ClientConnection) error) error {
 	s.connectionsMutex.Lock()
 	defer s.connectionsMutex.Unlock()
 	for _, conn := range s.connections {
@@ -62,11 +140,136 @@ func (s *Server) ProcessConnections(execution func(conn *connection.ClientConnec
 	return nil
 }
 
-func (s *Server) Array() []int32 {
-	return s.versioner.State.Copy()
+func (s *ServerOf[T]) Array() []T {
+	_, array := s.versioner.GetCurrentState()
+	return array
+}
+
+// ArrayAt returns the array as it was at the given version, if that version is still kept in history
+func (s *ServerOf[T]) ArrayAt(version int) ([]T, error) {
+	return s.versioner.StateAt(version)
+}
+
+// PersistCheckpoints makes the server keep checkpoints in the directory, loading the ones already stored there
+func (s *ServerOf[T]) PersistCheckpoints(directory string) error {
+	checkpoints, err := state.NewCheckpointStoreWithCodec(s.versioner.State.Codec(), directory)
+	if err != nil {
+		return err
+	}
+	s.checkpoints = checkpoints
+	return nil
+}
+
+// CreateCheckpoint tags the current version of the array with the name. History is kept back to the version until
+// the checkpoint is deleted, so that reverting to the checkpoint commits the inverse of what has been done since then.
+func (s *ServerOf[T]) CreateCheckpoint(name string) (state.Checkpoint, error) {
+	if err := s.versioner.State.Flush(); err != nil {
+		return state.Checkpoint{}, err
+	}
+	previous, replaced, _ := s.checkpoints.Lookup(name)
+	version, snapshot := s.versioner.RetainSnapshot()
+	defer snapshot.Release()
+	checkpoint := state.Checkpoint{Name: name, Version: version, CreatedAt: time.Now()}
+	if err := s.checkpoints.Save(checkpoint, snapshot); err != nil {
+		s.versioner.Release(version)
+		return checkpoint, err
+	}
+	if replaced {
+		s.versioner.Release(previous.Version)
+	}
+	return checkpoint, nil
+}
+
+// SetRetentionLimit defines how many operations history could keep because of the checkpoints; reverting to older
+// ones restores their arrays if they are persisted
+func (s *ServerOf[T]) SetRetentionLimit(operations int) {
+	s.versioner.SetRetentionLimit(operations)
+}
+
+// DeleteCheckpoint removes the checkpoint, so that history is no longer kept back to its version
+func (s *ServerOf[T]) DeleteCheckpoint(name string) error {
+	checkpoint, created, err := s.checkpoints.Delete(name)
+	if err != nil {
+		return err
+	}
+	if created {
+		s.versioner.Release(checkpoint.Version)
+	}
+	return nil
+}
+
+// Close releases the storage of the document; the server must not be used afterwards
+func (s *ServerOf[T]) Close() error {
+	return s.versioner.State.Close()
+}
+
+// RevertToCheckpoint restores the array tagged with the name as a new version, that is returned
+func (s *ServerOf[T]) RevertToCheckpoint(name string) (int, error) {
+	checkpoint, created, err := s.checkpoints.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if created {
+		version, err := s.versioner.RevertTo(checkpoint.Version)
+		if !errors.Is(err, state.ErrHistoryTrimmed) {
+			return version, err
+		}
+	}
+	// the checkpoint is either left from before a restart, so its version means nothing to the current history,
+	// or older than the history retained
+	array, err := s.checkpoints.Load(name)
+	if err != nil {
+		return 0, err
+	}
+	return s.versioner.Restore(array)
+}
+
+func (s *ServerOf[T]) Checkpoints() []state.Checkpoint {
+	return s.checkpoints.List()
+}
+
+// RevertOperation undoes the single operation committed at the given version, keeping everything done after it.
+// The revert is committed as a new version, that is returned.
+func (s *ServerOf[T]) RevertOperation(version int) (int, error) {
+	return s.versioner.Revert(version)
+}
+
+// History returns operations committed since the version along with their metadata
+func (s *ServerOf[T]) History(version int) ([]state.Operation, []state.Metadata, error) {
+	return s.versioner.GetHistorySince(version)
+}
+
+// Blame tells who and when produced every element in [from, to) of the current array, which version is returned too
+func (s *ServerOf[T]) Blame(from, to int) (int, []state.Metadata, error) {
+	return s.versioner.Blame(from, to)
+}
+
+// EnableSortedMode makes the server keep the document sorted: clients insert values with OpInsertSorted and the server
+// chooses their positions, while operations breaking the order are rejected. The initial array is sorted already.
+func (s *ServerOf[T]) EnableSortedMode() error {
+	return s.versioner.State.EnableSortedMode()
+}
+
+// EnableIndex makes the server maintain the index of values in the document, speeding up IndexOf and CountOf
+func (s *ServerOf[T]) EnableIndex() {
+	s.versioner.State.EnableIndex()
+}
+
+// IndexOf returns the first position of the value in the current array or -1 if there is none
+func (s *ServerOf[T]) IndexOf(value T) int {
+	return s.versioner.State.IndexOf(value)
+}
+
+func (s *ServerOf[T]) Contains(value T) bool {
+	return s.versioner.State.Contains(value)
+}
+
+// CountOf returns the number of occurrences of the value in the current array
+func (s *ServerOf[T]) CountOf(value T) int {
+	return s.versioner.State.CountOf(value)
 }
 
-func (s *Server) initArray(size int) []int32 {
+func initArray(size int) []int32 {
 	array := make([]int32, size)
 	for i := 0; i < size; i++ {
 		array[i] = int32(rand.Uint32())
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RinesThaix/homeTask/state"
+	"github.com/RinesThaix/homeTask/util"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotTimeout = time.Minute
+	maxChunkSize    = 1 << 20
+)
+
+// ErrUnknownSnapshot is returned for requests to snapshots that have expired or never existed
+var ErrUnknownSnapshot = errors.New("unknown or expired snapshot")
+
+type (
+	// snapshot is a consistent copy of the array at some version, that a client reads through several requests
+	snapshot[T comparable] struct {
+		version   int
+		array     *state.SnapshotOf[T]
+		tree      *util.MerkleTree
+		expiresAt time.Time
+	}
+
+	snapshots[T comparable] struct {
+		lastID int
+		byID   map[int]*snapshot[T]
+		mutex  sync.Mutex
+	}
+)
+
+func newSnapshots[T comparable]() *snapshots[T] {
+	return &snapshots[T]{byID: make(map[int]*snapshot[T]), mutex: sync.Mutex{}}
+}
+
+func (s *snapshots[T]) create(version int, array *state.SnapshotOf[T]) (int, *snapshot[T]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(time.Now())
+	s.lastID++
+	snap := &snapshot[T]{version: version, array: array, expiresAt: time.Now().Add(snapshotTimeout)}
+	s.byID[s.lastID] = snap
+	return s.lastID, snap
+}
+
+// get returns the snapshot prolonging its life
+func (s *snapshots[T]) get(id int) (*snapshot[T], error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.expire(now)
+	snap, ok := s.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSnapshot, id)
+	}
+	snap.expiresAt = now.Add(snapshotTimeout)
+	return snap, nil
+}
+
+// delete drops the snapshot once the client is done with it, without waiting for it to expire
+func (s *snapshots[T]) delete(id int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if snap, ok := s.byID[id]; ok {
+		delete(s.byID, id)
+		snap.array.Release()
+	}
+}
+
+func (s *snapshots[T]) expire(now time.Time) {
+	for id, snap := range s.byID {
+		if now.After(snap.expiresAt) {
+			delete(s.byID, id)
+			snap.array.Release()
+		}
+	}
+}
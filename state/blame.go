@@ -0,0 +1,58 @@
+package state
+
+// traceBack returns the position an element at pos had before the operation, and whether the operation produced its value
+func traceBack[T comparable](operation Operation, pos int) (int, bool) {
+	switch op := operation.(type) {
+	case *OpInsertOf[T]:
+		if pos == op.Position {
+			return pos, true
+		}
+		if pos > op.Position {
+			return pos - 1, false
+		}
+	case *OpUpdateOf[T]:
+		return pos, pos == op.Position
+	case *OpCompareAndSetOf[T]:
+		return pos, pos == op.Position && op.Value != op.Expected
+	case *OpAdd:
+		return pos, pos == op.Position && op.Delta != 0
+	case *OpDeleteOf[T]:
+		if pos >= op.Position {
+			return pos + 1, false
+		}
+	case *OpMoveOf[T]:
+		if op.From != op.To {
+			return movedPosition(pos, op.To, op.From), false
+		}
+	case *OpInsertSortedOf[T]:
+		if pos == op.Position {
+			return pos, true
+		}
+		if pos > op.Position {
+			return pos - 1, false
+		}
+	case *OpUpdateSortedOf[T]:
+		if pos == op.To {
+			return op.Position, true
+		}
+		return movedPosition(pos, op.To, op.Position), false
+	case *OpInsertText:
+		if length := op.Length(); pos >= op.Position+length {
+			return pos - length, false
+		} else if pos >= op.Position {
+			return pos, true
+		}
+	case *OpDeleteText:
+		if pos >= op.Position {
+			return pos + op.Length, false
+		}
+	case *OpBatch:
+		for i := len(op.Operations) - 1; i >= 0; i-- {
+			var produced bool
+			if pos, produced = traceBack[T](op.Operations[i], pos); produced {
+				return pos, true
+			}
+		}
+	}
+	return pos, false
+}
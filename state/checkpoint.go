@@ -0,0 +1,258 @@
+package state
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/RinesThaix/homeTask/util"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointExtension = ".checkpoint"
+	// checkpointChunkSize is how many elements of the stored array are encoded at once
+	checkpointChunkSize = 1 << 16
+)
+
+type (
+	Checkpoint struct {
+		Name      string
+		Version   int
+		CreatedAt time.Time
+	}
+
+	// CheckpointStoreOf keeps named versions of the array, that are restored through history, so with an empty
+	// directory only the checkpoints themselves are kept in memory. Otherwise every checkpoint is written to its own file
+	// along with the array encoded with the codec, so that it could be restored after a restart as well. The files are
+	// only read up to the checkpoint when opened, the arrays are decoded once restored.
+	CheckpointStoreOf[T comparable] struct {
+		codec       util.Codec[T]
+		directory   string
+		checkpoints map[string]Checkpoint
+		// created holds the names of the checkpoints saved since the store was opened, whose versions are in history
+		created map[string]bool
+		mutex   sync.RWMutex
+	}
+
+	CheckpointStore = CheckpointStoreOf[int32]
+)
+
+func NewCheckpointStore(directory string) (*CheckpointStore, error) {
+	return NewCheckpointStoreWithCodec(util.Int32Codec, directory)
+}
+
+// NewCheckpointStoreWithCodec creates the store of arrays of elements of type T, that are written with the codec
+func NewCheckpointStoreWithCodec[T comparable](codec util.Codec[T], directory string) (*CheckpointStoreOf[T], error) {
+	cs := &CheckpointStoreOf[T]{
+		codec:       codec,
+		directory:   directory,
+		checkpoints: make(map[string]Checkpoint),
+		created:     make(map[string]bool),
+		mutex:       sync.RWMutex{},
+	}
+	if directory == "" {
+		return cs, nil
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("could not create checkpoint directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(directory, "*"+checkpointExtension))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		checkpoint, err := cs.read(file, nil)
+		if err != nil {
+			return nil, err
+		}
+		cs.checkpoints[checkpoint.Name] = checkpoint
+	}
+	return cs, nil
+}
+
+// Save stores the checkpoint, writing the array of the snapshot taken at its version unless the store is in memory
+func (cs *CheckpointStoreOf[T]) Save(checkpoint Checkpoint, snapshot *SnapshotOf[T]) error {
+	if checkpoint.Name == "" || strings.ContainsAny(checkpoint.Name, `/\`) || strings.HasPrefix(checkpoint.Name, ".") {
+		return fmt.Errorf("invalid checkpoint name: %q", checkpoint.Name)
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.directory != "" {
+		if err := cs.write(checkpoint, snapshot); err != nil {
+			return err
+		}
+	}
+	cs.checkpoints[checkpoint.Name] = checkpoint
+	cs.created[checkpoint.Name] = true
+	return nil
+}
+
+// Lookup returns the checkpoint and whether it was saved since the store was opened, so that its version is still
+// the version of the current history rather than of the one before a restart
+func (cs *CheckpointStoreOf[T]) Lookup(name string) (Checkpoint, bool, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	checkpoint, ok := cs.checkpoints[name]
+	if !ok {
+		return Checkpoint{}, false, fmt.Errorf("unknown checkpoint: %q", name)
+	}
+	return checkpoint, cs.created[name], nil
+}
+
+// Delete removes the checkpoint along with its file; like Lookup, returns it and whether it was saved since the store
+// was opened, so that the caller could release its version
+func (cs *CheckpointStoreOf[T]) Delete(name string) (Checkpoint, bool, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	checkpoint, ok := cs.checkpoints[name]
+	if !ok {
+		return Checkpoint{}, false, fmt.Errorf("unknown checkpoint: %q", name)
+	}
+	if cs.directory != "" {
+		if err := os.Remove(cs.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return Checkpoint{}, false, fmt.Errorf("could not delete checkpoint %q: %w", name, err)
+		}
+	}
+	created := cs.created[name]
+	delete(cs.checkpoints, name)
+	delete(cs.created, name)
+	return checkpoint, created, nil
+}
+
+// Load reads the array stored along with the checkpoint
+func (cs *CheckpointStoreOf[T]) Load(name string) ([]T, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	if _, ok := cs.checkpoints[name]; !ok {
+		return nil, fmt.Errorf("unknown checkpoint: %q", name)
+	}
+	if cs.directory == "" {
+		return nil, fmt.Errorf("could not load checkpoint %q: its array is not persisted", name)
+	}
+	array := make([]T, 0)
+	if _, err := cs.read(cs.path(name), &array); err != nil {
+		return nil, err
+	}
+	return array, nil
+}
+
+// List returns all the checkpoints ordered by version
+func (cs *CheckpointStoreOf[T]) List() []Checkpoint {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	result := make([]Checkpoint, 0, len(cs.checkpoints))
+	for _, checkpoint := range cs.checkpoints {
+		result = append(result, checkpoint)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Version == result[j].Version {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].Version < result[j].Version
+	})
+	return result
+}
+
+func (cs *CheckpointStoreOf[T]) path(name string) string {
+	return filepath.Join(cs.directory, name+checkpointExtension)
+}
+
+// read decodes the checkpoint from the file, followed by its array if the destination for it is given
+func (cs *CheckpointStoreOf[T]) read(file string, array *[]T) (Checkpoint, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("could not open checkpoint: %w", err)
+	}
+	defer f.Close()
+	decoder := gob.NewDecoder(bufio.NewReader(f))
+	var checkpoint Checkpoint
+	if err := decoder.Decode(&checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("could not read checkpoint %s: %w", file, err)
+	}
+	if array == nil {
+		return checkpoint, nil
+	}
+	for {
+		var chunk []byte
+		if err := decoder.Decode(&chunk); errors.Is(err, io.EOF) {
+			return checkpoint, nil
+		} else if err != nil {
+			return Checkpoint{}, fmt.Errorf("could not read array of checkpoint %s: %w", file, err)
+		}
+		values, err := util.Decode(cs.codec, chunk)
+		if err != nil {
+			return Checkpoint{}, fmt.Errorf("could not decode array of checkpoint %s: %w", file, err)
+		}
+		*array = append(*array, values...)
+	}
+}
+
+// write encodes the checkpoint followed by the array of the snapshot in chunks, so that it is never copied as a whole
+func (cs *CheckpointStoreOf[T]) write(checkpoint Checkpoint, snapshot *SnapshotOf[T]) error {
+	// writing into a temporary file first, so that a crash never leaves a broken checkpoint behind
+	f, err := os.CreateTemp(cs.directory, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	writer := bufio.NewWriter(f)
+	encoder := gob.NewEncoder(writer)
+	err = encoder.Encode(checkpoint)
+	for from := 0; err == nil && from < snapshot.Size(); from += checkpointChunkSize {
+		to := from + checkpointChunkSize
+		if to > snapshot.Size() {
+			to = snapshot.Size()
+		}
+		var values []T
+		if values, err = snapshot.Range(from, to); err == nil {
+			err = encoder.Encode(util.Encode(cs.codec, values))
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	return os.Rename(f.Name(), cs.path(checkpoint.Name))
+}
+
+// Diff builds the batch that turns array from into array to
+func Diff[T comparable](from, to []T) *OpBatch {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	fromMiddle, toMiddle := from[prefix:len(from)-suffix], to[prefix:len(to)-suffix]
+	operations := make([]Operation, 0)
+	common := len(fromMiddle)
+	if len(toMiddle) < common {
+		common = len(toMiddle)
+	}
+	for i := 0; i < common; i++ {
+		if fromMiddle[i] != toMiddle[i] {
+			operations = append(operations, &OpUpdateOf[T]{Position: prefix + i, Value: toMiddle[i], PreviousValue: fromMiddle[i]})
+		}
+	}
+	for i := common; i < len(fromMiddle); i++ {
+		operations = append(operations, &OpDeleteOf[T]{Position: prefix + common, PreviousValue: fromMiddle[i]})
+	}
+	for i := common; i < len(toMiddle); i++ {
+		operations = append(operations, &OpInsertOf[T]{Position: prefix + i, Value: toMiddle[i]})
+	}
+	return &OpBatch{Operations: operations}
+}
@@ -0,0 +1,58 @@
+package state
+
+import "time"
+
+// DefaultDeduplicationWindow is how long the versioner remembers committed operations to recognize their retries
+const DefaultDeduplicationWindow = time.Minute
+
+type (
+	operationKey struct {
+		clientID    string
+		operationID uint64
+	}
+
+	committedKey struct {
+		key         operationKey
+		committedAt time.Time
+	}
+
+	// deduplicator remembers versions client operations were committed at within the retention window
+	deduplicator struct {
+		window    time.Duration
+		versions  map[operationKey]int
+		committed []committedKey
+	}
+)
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{window: window, versions: make(map[operationKey]int)}
+}
+
+// lookup returns the version the operation was committed at, if it was
+func (d *deduplicator) lookup(metadata Metadata) (int, bool) {
+	if metadata.ClientID == "" || metadata.OperationID == 0 {
+		return 0, false
+	}
+	d.expire(time.Now())
+	version, ok := d.versions[operationKey{clientID: metadata.ClientID, operationID: metadata.OperationID}]
+	return version, ok
+}
+
+func (d *deduplicator) remember(metadata Metadata) {
+	if metadata.ClientID == "" || metadata.OperationID == 0 {
+		return
+	}
+	key := operationKey{clientID: metadata.ClientID, operationID: metadata.OperationID}
+	d.versions[key] = metadata.Version
+	d.committed = append(d.committed, committedKey{key: key, committedAt: metadata.Timestamp})
+	d.expire(metadata.Timestamp)
+}
+
+func (d *deduplicator) expire(now time.Time) {
+	expired := 0
+	for expired < len(d.committed) && now.Sub(d.committed[expired].committedAt) > d.window {
+		delete(d.versions, d.committed[expired].key)
+		expired++
+	}
+	d.committed = d.committed[expired:]
+}
@@ -0,0 +1,211 @@
+package state
+
+import (
+	"github.com/RinesThaix/homeTask/util"
+	"math"
+)
+
+const minIndexChunkSize = 64
+
+type (
+	// indexChunk is a run of consecutive positions of the array, index being its number among the chunks
+	indexChunk struct {
+		size  int
+		index int
+	}
+
+	occurrence struct {
+		chunk *indexChunk
+		count int
+	}
+
+	// valueIndex maps values to the chunks of positions holding them. Positions the chunks start at are kept in
+	// a Fenwick tree, so inserts and deletes shift all the later positions without touching them, and a value is
+	// found by scanning the first chunk it occurs in. The elements themselves are read from the array.
+	valueIndex[T comparable] struct {
+		chunks      []*indexChunk
+		offsets     util.Fenwick
+		chunkSize   int
+		occurrences map[T][]occurrence
+	}
+)
+
+func newValueIndex[T comparable](array util.SequenceOf[T]) *valueIndex[T] {
+	index := &valueIndex[T]{}
+	index.build(array)
+	return index
+}
+
+// build indexes all the elements of the array anew
+func (vi *valueIndex[T]) build(array util.SequenceOf[T]) {
+	size := array.Size()
+	vi.chunkSize = int(math.Sqrt(float64(size)))
+	if vi.chunkSize < minIndexChunkSize {
+		vi.chunkSize = minIndexChunkSize
+	}
+	vi.chunks = vi.chunks[:0]
+	vi.occurrences = make(map[T][]occurrence)
+	for from := 0; from < size || len(vi.chunks) == 0; from += vi.chunkSize {
+		chunk := &indexChunk{size: vi.chunkSize, index: len(vi.chunks)}
+		if from+chunk.size > size {
+			chunk.size = size - from
+		}
+		array.Iterate(from, from+chunk.size, func(_ int, value T) bool {
+			vi.add(value, chunk, 1)
+			return true
+		})
+		vi.chunks = append(vi.chunks, chunk)
+	}
+	vi.rebuildOffsets()
+}
+
+// insert indexes the value that has just been inserted into the array at the position
+func (vi *valueIndex[T]) insert(array util.SequenceOf[T], pos int, value T) {
+	chunkIndex := vi.locate(pos)
+	chunk := vi.chunks[chunkIndex]
+	chunk.size++
+	vi.offsets.Add(chunkIndex, 1)
+	vi.add(value, chunk, 1)
+	if chunk.size > vi.chunkSize<<1 {
+		vi.split(array, chunkIndex)
+	}
+}
+
+// delete forgets the value that has just been deleted from the array at the position
+func (vi *valueIndex[T]) delete(array util.SequenceOf[T], pos int, value T) {
+	chunkIndex := vi.locate(pos)
+	chunk := vi.chunks[chunkIndex]
+	chunk.size--
+	vi.offsets.Add(chunkIndex, -1)
+	vi.add(value, chunk, -1)
+	if chunk.size < vi.chunkSize>>1 && len(vi.chunks) > 1 {
+		if chunkIndex == len(vi.chunks)-1 {
+			chunkIndex--
+		}
+		vi.merge(array, chunkIndex)
+	}
+}
+
+// update reindexes the element at the position, that has just been changed from the previous value to the value
+func (vi *valueIndex[T]) update(pos int, previous, value T) {
+	if previous == value {
+		return
+	}
+	chunk := vi.chunks[vi.locate(pos)]
+	vi.add(previous, chunk, -1)
+	vi.add(value, chunk, 1)
+}
+
+// indexOf returns the first position of the value in the array or -1 if there is none
+func (vi *valueIndex[T]) indexOf(array util.SequenceOf[T], value T) int {
+	occurrences := vi.occurrences[value]
+	if len(occurrences) == 0 {
+		return -1
+	}
+	first := occurrences[0].chunk
+	for _, occurrence := range occurrences[1:] {
+		if occurrence.chunk.index < first.index {
+			first = occurrence.chunk
+		}
+	}
+	start, result := vi.offsets.Prefix(first.index), -1
+	array.Iterate(start, start+first.size, func(pos int, element T) bool {
+		if element == value {
+			result = pos
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+func (vi *valueIndex[T]) countOf(value T) int {
+	count := 0
+	for _, occurrence := range vi.occurrences[value] {
+		count += occurrence.count
+	}
+	return count
+}
+
+// add changes the number of occurrences of the value in the chunk by delta
+func (vi *valueIndex[T]) add(value T, chunk *indexChunk, delta int) {
+	occurrences := vi.occurrences[value]
+	for i := range occurrences {
+		if occurrences[i].chunk != chunk {
+			continue
+		}
+		if occurrences[i].count += delta; occurrences[i].count != 0 {
+			return
+		}
+		last := len(occurrences) - 1
+		occurrences[i] = occurrences[last]
+		if last == 0 {
+			delete(vi.occurrences, value)
+		} else {
+			vi.occurrences[value] = occurrences[:last]
+		}
+		return
+	}
+	vi.occurrences[value] = append(occurrences, occurrence{chunk: chunk, count: delta})
+}
+
+// split moves the second half of the chunk into a new one right after it
+func (vi *valueIndex[T]) split(array util.SequenceOf[T], chunkIndex int) {
+	chunk := vi.chunks[chunkIndex]
+	half := chunk.size >> 1
+	next := &indexChunk{size: chunk.size - half}
+	start := vi.offsets.Prefix(chunkIndex) + half
+	vi.move(array, start, next.size, chunk, next)
+	chunk.size = half
+	vi.chunks = append(vi.chunks, nil)
+	copy(vi.chunks[chunkIndex+2:], vi.chunks[chunkIndex+1:])
+	vi.chunks[chunkIndex+1] = next
+	vi.renumber(chunkIndex + 1)
+	vi.rebuildOffsets()
+}
+
+// merge moves all of the chunk after the given one into it, splitting the result if it becomes too large
+func (vi *valueIndex[T]) merge(array util.SequenceOf[T], chunkIndex int) {
+	chunk, next := vi.chunks[chunkIndex], vi.chunks[chunkIndex+1]
+	start := vi.offsets.Prefix(chunkIndex + 1)
+	vi.move(array, start, next.size, next, chunk)
+	chunk.size += next.size
+	vi.chunks = append(vi.chunks[:chunkIndex+1], vi.chunks[chunkIndex+2:]...)
+	vi.renumber(chunkIndex + 1)
+	vi.rebuildOffsets()
+	if chunk.size > vi.chunkSize<<1 {
+		vi.split(array, chunkIndex)
+	}
+}
+
+// move reassigns occurrences of the elements in [start, start+size) from one chunk to another
+func (vi *valueIndex[T]) move(array util.SequenceOf[T], start, size int, from, to *indexChunk) {
+	array.Iterate(start, start+size, func(_ int, value T) bool {
+		vi.add(value, from, -1)
+		vi.add(value, to, 1)
+		return true
+	})
+}
+
+func (vi *valueIndex[T]) renumber(from int) {
+	for i := from; i < len(vi.chunks); i++ {
+		vi.chunks[i].index = i
+	}
+}
+
+func (vi *valueIndex[T]) rebuildOffsets() {
+	sizes := make([]int, len(vi.chunks))
+	for i, chunk := range vi.chunks {
+		sizes[i] = chunk.size
+	}
+	vi.offsets = util.NewFenwick(sizes)
+}
+
+// locate returns the chunk containing the position; the position right after the last element is in the last chunk
+func (vi *valueIndex[T]) locate(pos int) int {
+	chunkIndex, _ := vi.offsets.Search(pos)
+	if chunkIndex == len(vi.chunks) {
+		chunkIndex--
+	}
+	return chunkIndex
+}
@@ -0,0 +1,23 @@
+package state
+
+import (
+	"fmt"
+	"time"
+)
+
+// SystemClientID is the author of operations committed by the server itself, e.g. reverts
+const SystemClientID = "system"
+
+// Metadata is the envelope of an operation: the client fills in who sent it, the server fills in when and at which
+// version it was committed, as well as the checksum of the array right after it
+type Metadata struct {
+	ClientID    string
+	OperationID uint64
+	Timestamp   time.Time
+	Version     int
+	Checksum    uint64
+}
+
+func (m Metadata) String() string {
+	return fmt.Sprintf("meta{client=%s,op=%d,version=%d,time=%s,checksum=%x}", m.ClientID, m.OperationID, m.Version, m.Timestamp.Format(time.RFC3339Nano), m.Checksum)
+}
@@ -3,62 +3,207 @@ package state
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
+)
+
+// OverflowPolicy defines what OpAdd does when the result does not fit into int32
+type OverflowPolicy int
+
+const (
+	OverflowWrap OverflowPolicy = iota
+	// OverflowSaturate clamps the result to the bounds of int32. Saturated additions do not commute,
+	// so replicas agree only because everyone applies them in the order the server has committed them.
+	OverflowSaturate
+	OverflowReject
 )
 
 type (
 	Operation interface {
 		fmt.Stringer
 		Copy() Operation
+		// Inverse returns the operation that cancels this one out when applied right after it
+		Inverse() Operation
 	}
 
-	OpInsert struct {
+	OpInsertOf[T comparable] struct {
 		Position int
-		Value    int32
+		Value    T
 	}
 
-	OpUpdate struct {
+	OpUpdateOf[T comparable] struct {
 		Position      int
-		Value         int32
-		PreviousValue int32
+		Value         T
+		PreviousValue T
 	}
 
-	OpDelete struct {
+	OpDeleteOf[T comparable] struct {
 		Position      int
+		PreviousValue T
+	}
+
+	// OpCompareAndSetOf updates the element only if it still holds the expected value.
+	// With Value equal to Expected it works as a pure guard, e.g. inside of OpBatch.
+	OpCompareAndSetOf[T comparable] struct {
+		Position int
+		Expected T
+		Value    T
+	}
+
+	// OpAdd is supported by the states of int32 elements only; zero Delta makes it a no-op,
+	// that is what an addition to the element deleted concurrently turns into
+	OpAdd struct {
+		Position      int
+		Delta         int32
+		Overflow      OverflowPolicy
 		PreviousValue int32
 	}
 
+	// OpMoveOf takes the element at From out and puts it back so that it ends up at To.
+	// Value is filled in when the operation is applied and lets others see what was moved.
+	OpMoveOf[T comparable] struct {
+		From  int
+		To    int
+		Value T
+	}
+
+	// OpBatch applies the operations one after another; an empty batch is a no-op, that is what an update of
+	// the element deleted concurrently turns into
 	OpBatch struct {
 		Operations []Operation
 	}
+
+	// OpInsertSortedOf inserts the value into the sorted array right after the elements not greater than it.
+	// Position is chosen when the operation is applied, so that everyone replays it at the same place.
+	OpInsertSortedOf[T comparable] struct {
+		Position int
+		Value    T
+	}
+
+	// OpUpdateSortedOf replaces the element at Position with the value and moves it to To, where it keeps the array
+	// sorted. To and PreviousValue are filled in when the operation is applied.
+	OpUpdateSortedOf[T comparable] struct {
+		Position      int
+		To            int
+		Value         T
+		PreviousValue T
+	}
+
+	// OpInsertText inserts the runes of the text into the document of runes, so that the first one ends up at Position.
+	// Like OpAdd, it is supported by the states of int32 elements only.
+	OpInsertText struct {
+		Position int
+		Text     string
+	}
+
+	// OpDeleteText removes Length runes starting at Position; PreviousText is filled in when the operation is applied
+	OpDeleteText struct {
+		Position     int
+		Length       int
+		PreviousText string
+	}
+)
+
+// operations on int32 elements
+type (
+	OpInsert        = OpInsertOf[int32]
+	OpUpdate        = OpUpdateOf[int32]
+	OpDelete        = OpDeleteOf[int32]
+	OpCompareAndSet = OpCompareAndSetOf[int32]
+	OpMove          = OpMoveOf[int32]
+	OpInsertSorted  = OpInsertSortedOf[int32]
+	OpUpdateSorted  = OpUpdateSortedOf[int32]
 )
 
-func (op *OpInsert) Copy() Operation {
-	return &OpInsert{Position: op.Position, Value: op.Value}
+func (op *OpInsertOf[T]) Copy() Operation {
+	return &OpInsertOf[T]{Position: op.Position, Value: op.Value}
+}
+
+func (op *OpInsertOf[T]) Inverse() Operation {
+	return &OpDeleteOf[T]{Position: op.Position, PreviousValue: op.Value}
 }
 
-func (op *OpInsert) String() string {
-	return fmt.Sprintf("insert{pos=%d,value=%d}", op.Position, op.Value)
+func (op *OpInsertOf[T]) String() string {
+	return fmt.Sprintf("insert{pos=%d,value=%v}", op.Position, op.Value)
 }
 
-func (op *OpUpdate) Copy() Operation {
-	return &OpUpdate{Position: op.Position, Value: op.Value, PreviousValue: op.PreviousValue}
+func (op *OpUpdateOf[T]) Copy() Operation {
+	return &OpUpdateOf[T]{Position: op.Position, Value: op.Value, PreviousValue: op.PreviousValue}
 }
 
-func (op *OpUpdate) String() string {
-	return fmt.Sprintf("update{pos=%d,value=%d}", op.Position, op.Value)
+func (op *OpUpdateOf[T]) Inverse() Operation {
+	return &OpUpdateOf[T]{Position: op.Position, Value: op.PreviousValue, PreviousValue: op.Value}
 }
 
-func (op *OpDelete) Copy() Operation {
-	return &OpDelete{Position: op.Position, PreviousValue: op.PreviousValue}
+func (op *OpUpdateOf[T]) String() string {
+	return fmt.Sprintf("update{pos=%d,value=%v}", op.Position, op.Value)
 }
 
-func (op *OpDelete) String() string {
+func (op *OpDeleteOf[T]) Copy() Operation {
+	return &OpDeleteOf[T]{Position: op.Position, PreviousValue: op.PreviousValue}
+}
+
+func (op *OpDeleteOf[T]) Inverse() Operation {
+	return &OpInsertOf[T]{Position: op.Position, Value: op.PreviousValue}
+}
+
+func (op *OpDeleteOf[T]) String() string {
 	return fmt.Sprintf("delete{pos=%d}", op.Position)
 }
 
+func (op *OpCompareAndSetOf[T]) Copy() Operation {
+	return &OpCompareAndSetOf[T]{Position: op.Position, Expected: op.Expected, Value: op.Value}
+}
+
+func (op *OpCompareAndSetOf[T]) Inverse() Operation {
+	return &OpCompareAndSetOf[T]{Position: op.Position, Expected: op.Value, Value: op.Expected}
+}
+
+func (op *OpCompareAndSetOf[T]) String() string {
+	return fmt.Sprintf("cas{pos=%d,expected=%v,value=%v}", op.Position, op.Expected, op.Value)
+}
+
+func (op *OpAdd) Copy() Operation {
+	return &OpAdd{Position: op.Position, Delta: op.Delta, Overflow: op.Overflow, PreviousValue: op.PreviousValue}
+}
+
+// Inverse takes away what the addition has actually added, that is less than Delta if the result got saturated
+func (op *OpAdd) Inverse() Operation {
+	delta := op.Delta
+	if value, ok := added(op.PreviousValue, op.Delta, op.Overflow); ok {
+		delta = value - op.PreviousValue
+	}
+	return &OpAdd{Position: op.Position, Delta: -delta, Overflow: op.Overflow}
+}
+
+func (op *OpAdd) String() string {
+	return fmt.Sprintf("add{pos=%d,delta=%d}", op.Position, op.Delta)
+}
+
+func (op *OpMoveOf[T]) Copy() Operation {
+	return &OpMoveOf[T]{From: op.From, To: op.To, Value: op.Value}
+}
+
+func (op *OpMoveOf[T]) Inverse() Operation {
+	return &OpMoveOf[T]{From: op.To, To: op.From, Value: op.Value}
+}
+
+func (op *OpMoveOf[T]) String() string {
+	return fmt.Sprintf("move{from=%d,to=%d}", op.From, op.To)
+}
+
 func (op *OpBatch) Copy() Operation {
 	operations := make([]Operation, len(op.Operations))
-	copy(operations, op.Operations)
+	for i, o := range op.Operations {
+		operations[i] = o.Copy()
+	}
+	return &OpBatch{Operations: operations}
+}
+
+func (op *OpBatch) Inverse() Operation {
+	operations := make([]Operation, len(op.Operations))
+	for i, o := range op.Operations {
+		operations[len(operations)-1-i] = o.Inverse()
+	}
 	return &OpBatch{Operations: operations}
 }
 
@@ -69,3 +214,80 @@ func (op *OpBatch) String() string {
 	}
 	return fmt.Sprintf("batch{%s}", strings.Join(children, ","))
 }
+
+func (op *OpInsertSortedOf[T]) Copy() Operation {
+	return &OpInsertSortedOf[T]{Position: op.Position, Value: op.Value}
+}
+
+func (op *OpInsertSortedOf[T]) Inverse() Operation {
+	return &OpDeleteOf[T]{Position: op.Position, PreviousValue: op.Value}
+}
+
+func (op *OpInsertSortedOf[T]) String() string {
+	return fmt.Sprintf("insertSorted{pos=%d,value=%v}", op.Position, op.Value)
+}
+
+func (op *OpUpdateSortedOf[T]) Copy() Operation {
+	return &OpUpdateSortedOf[T]{Position: op.Position, To: op.To, Value: op.Value, PreviousValue: op.PreviousValue}
+}
+
+func (op *OpUpdateSortedOf[T]) Inverse() Operation {
+	return &OpUpdateSortedOf[T]{Position: op.To, To: op.Position, Value: op.PreviousValue, PreviousValue: op.Value}
+}
+
+func (op *OpUpdateSortedOf[T]) String() string {
+	return fmt.Sprintf("updateSorted{pos=%d,to=%d,value=%v}", op.Position, op.To, op.Value)
+}
+
+func (op *OpInsertText) Copy() Operation {
+	return &OpInsertText{Position: op.Position, Text: op.Text}
+}
+
+func (op *OpInsertText) Inverse() Operation {
+	return &OpDeleteText{Position: op.Position, Length: op.Length(), PreviousText: op.Text}
+}
+
+func (op *OpInsertText) String() string {
+	return fmt.Sprintf("insertText{pos=%d,text=%q}", op.Position, op.Text)
+}
+
+// Length returns the number of runes inserted
+func (op *OpInsertText) Length() int {
+	return utf8.RuneCountInString(op.Text)
+}
+
+func (op *OpDeleteText) Copy() Operation {
+	return &OpDeleteText{Position: op.Position, Length: op.Length, PreviousText: op.PreviousText}
+}
+
+func (op *OpDeleteText) Inverse() Operation {
+	return &OpInsertText{Position: op.Position, Text: op.PreviousText}
+}
+
+func (op *OpDeleteText) String() string {
+	return fmt.Sprintf("deleteText{pos=%d,length=%d}", op.Position, op.Length)
+}
+
+// SortedForm returns the operation with all the inserts and updates replaced by the ones keeping the array sorted,
+// so that e.g. the inverse of a deletion puts the element back where it belongs by now
+func SortedForm(operation Operation) Operation {
+	return SortedFormOf[int32](operation)
+}
+
+// SortedFormOf is SortedForm for operations on elements of type T
+func SortedFormOf[T comparable](operation Operation) Operation {
+	switch op := operation.(type) {
+	case *OpInsertOf[T]:
+		return &OpInsertSortedOf[T]{Position: op.Position, Value: op.Value}
+	case *OpUpdateOf[T]:
+		return &OpUpdateSortedOf[T]{Position: op.Position, To: op.Position, Value: op.Value, PreviousValue: op.PreviousValue}
+	case *OpBatch:
+		operations := make([]Operation, len(op.Operations))
+		for i, o := range op.Operations {
+			operations[i] = SortedFormOf[T](o)
+		}
+		return &OpBatch{Operations: operations}
+	default:
+		return operation
+	}
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"fmt"
+	"github.com/RinesThaix/homeTask/util"
+)
+
+// SnapshotOf is a read-only copy of the state taken in O(1): it shares storage with the state, so that it could be
+// read at any pace while the state keeps being modified
+type SnapshotOf[T comparable] struct {
+	array util.SequenceOf[T]
+}
+
+type Snapshot = SnapshotOf[int32]
+
+// Snapshot takes a snapshot of the current elements
+func (s *StateOf[T]) Snapshot() *SnapshotOf[T] {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &SnapshotOf[T]{array: s.array.Snapshot()}
+}
+
+func (s *SnapshotOf[T]) Size() int {
+	return s.array.Size()
+}
+
+func (s *SnapshotOf[T]) Get(pos int) (T, error) {
+	if pos < 0 || pos >= s.array.Size() {
+		var zero T
+		return zero, fmt.Errorf("could not get: pos must be within bounds 0 <= %d < %d", pos, s.array.Size())
+	}
+	return s.array.Get(pos), util.Err(s.array)
+}
+
+// Range returns a copy of the elements in [from, to)
+func (s *SnapshotOf[T]) Range(from, to int) ([]T, error) {
+	if from < 0 || to > s.array.Size() || from > to {
+		return nil, fmt.Errorf("could not get range: [%d, %d) must be within bounds [0, %d)", from, to, s.array.Size())
+	}
+	return s.array.Range(from, to), util.Err(s.array)
+}
+
+// Array returns a copy of all the elements
+func (s *SnapshotOf[T]) Array() []T {
+	return s.array.GetAll()
+}
+
+// MerkleTree returns the tree over all the elements, see util.MerkleTree
+func (s *SnapshotOf[T]) MerkleTree(leafSize int) *util.MerkleTree {
+	return util.NewMerkleTreeOf(s.array, s.array.Size(), leafSize)
+}
+
+func (s *SnapshotOf[T]) Checksum() uint64 {
+	return s.array.Hash()
+}
+
+// Release lets the storage shared with the state go, after that the snapshot must not be used
+func (s *SnapshotOf[T]) Release() {
+	s.array.Release()
+}
@@ -1,42 +1,115 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"github.com/RinesThaix/homeTask/util"
+	"math"
+	"sort"
 	"sync"
 )
 
-type State struct {
+// ErrOrderViolated is returned when an operation would leave the array of the sorted state unsorted
+var ErrOrderViolated = errors.New("operation breaks the order of the sorted array")
+
+// ErrElementDeleted is returned when a conditional operation targets the element deleted concurrently
+var ErrElementDeleted = errors.New("element was deleted")
+
+// ConditionFailedErrorOf is returned when OpCompareAndSetOf finds some other value than the expected one
+type ConditionFailedErrorOf[T comparable] struct {
+	Position int
+	Expected T
+	Actual   T
+}
+
+type ConditionFailedError = ConditionFailedErrorOf[int32]
+
+func (e *ConditionFailedErrorOf[T]) Error() string {
+	return fmt.Sprintf("condition failed at pos %d: expected %v, found %v", e.Position, e.Expected, e.Actual)
+}
+
+// BatchError is returned when some operation of OpBatch could not be applied; the batch is left unapplied then
+type BatchError struct {
+	Index     int
+	Operation Operation
+	Err       error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation #%d %v failed: %v", e.Index, e.Operation, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// StateOf keeps the array of elements of type T, that are compared, hashed and serialized with the codec of its sequence
+type StateOf[T comparable] struct {
 	LastOp Operation
-	array  *util.BlockedArray
-	mutex  sync.RWMutex
+	array  util.SequenceOf[T]
+	index  *valueIndex[T]
+	// in the sorted mode descents is the number of adjacent pairs out of order, that is zero between operations
+	sorted   bool
+	descents int
+	mutex    sync.RWMutex
 }
 
+type State = StateOf[int32]
+
 func NewState(initialArray []int32) *State {
-	return &State{array: util.NewBlockedArray(initialArray, 10), mutex: sync.RWMutex{}}
+	return NewStateOf(util.BackendBlocked, initialArray)
+}
+
+// NewStateOf creates the state keeping its elements in the sequence of the given backend
+func NewStateOf(backend util.Backend, initialArray []int32) *State {
+	return NewStateWithCodec(util.Int32Codec, backend, initialArray)
+}
+
+// NewStateWithCodec creates the state of elements of type T keeping them in the sequence of the given backend
+func NewStateWithCodec[T comparable](codec util.Codec[T], backend util.Backend, initialArray []T) *StateOf[T] {
+	return &StateOf[T]{array: util.NewSequenceOf(codec, backend, initialArray), mutex: sync.RWMutex{}}
+}
+
+// NewStateFrom creates the state keeping its elements in the given sequence
+func NewStateFrom[T comparable](array util.SequenceOf[T]) *StateOf[T] {
+	return &StateOf[T]{array: array, mutex: sync.RWMutex{}}
 }
 
-func (s *State) Perform(operation Operation) error {
+// Perform applies the operation and records the values it overwrites into it, so that it could be rolled back or
+// inverted precisely later. Hence the caller must own the operation: the ones received from others go to PerformMany.
+func (s *StateOf[T]) Perform(operation Operation) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return s.perform(operation)
+	lastOp := s.LastOp
+	if err := s.perform(operation, true); err != nil {
+		return err
+	}
+	if s.descents > 0 {
+		// only the result must be sorted, so that batches may pass through unsorted arrays
+		if err := s.rollback(operation); err != nil {
+			return fmt.Errorf("could not rollback %v breaking the order: %w", operation, err)
+		}
+		s.LastOp = lastOp
+		return fmt.Errorf("could not perform %v: %w", operation, ErrOrderViolated)
+	}
+	return util.Err(s.array)
 }
 
-func (s *State) PerformMany(operations []Operation, offset int) error {
+func (s *StateOf[T]) PerformMany(operations []Operation, offset int) error {
 	if operations == nil {
 		return nil
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	for i := offset; i < len(operations); i++ {
-		if err := s.perform(operations[i]); err != nil {
+		if err := s.perform(operations[i], false); err != nil {
 			return err
 		}
 	}
-	return nil
+	return util.Err(s.array)
 }
 
-func (s *State) RollbackAndPerformMany(rollback Operation, operations []Operation) error {
+func (s *StateOf[T]) RollbackAndPerformMany(rollback Operation, operations []Operation) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	if err := s.rollback(rollback); err != nil {
@@ -44,38 +117,91 @@ func (s *State) RollbackAndPerformMany(rollback Operation, operations []Operatio
 	}
 	if operations != nil {
 		for _, op := range operations {
-			if err := s.perform(op); err != nil {
+			if err := s.perform(op, false); err != nil {
 				return err
 			}
 		}
 	}
-	return nil
+	return util.Err(s.array)
 }
 
-func (s *State) perform(operation Operation) error {
+func (s *StateOf[T]) perform(operation Operation, capture bool) error {
+	if capture {
+		s.capture(operation)
+	}
 	switch op := operation.(type) {
-	case *OpInsert:
+	case *OpInsertOf[T]:
 		if err := s.insert(op.Position, op.Value); err != nil {
 			return err
 		}
 		s.LastOp = operation
 		return nil
-	case *OpUpdate:
+	case *OpUpdateOf[T]:
 		if err := s.update(op.Position, op.Value); err != nil {
 			return err
 		}
 		s.LastOp = operation
 		return nil
-	case *OpDelete:
+	case *OpDeleteOf[T]:
 		if err := s.delete(op.Position); err != nil {
 			return err
 		}
 		s.LastOp = operation
 		return nil
+	case *OpCompareAndSetOf[T]:
+		if err := s.compareAndSet(op.Position, op.Expected, op.Value); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpAdd:
+		if err := s.add(op.Position, op.Delta, op.Overflow); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpMoveOf[T]:
+		if err := s.move(op.From, op.To); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpInsertSortedOf[T]:
+		if err := s.insert(op.Position, op.Value); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpUpdateSortedOf[T]:
+		if err := s.updateSorted(op.Position, op.To, op.Value); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpInsertText:
+		if err := s.insertText(op.Position, op.Text); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
+	case *OpDeleteText:
+		if err := s.deleteText(op.Position, op.Length); err != nil {
+			return err
+		}
+		s.LastOp = operation
+		return nil
 	case *OpBatch:
-		for _, el := range op.Operations {
-			if err := s.perform(el); err != nil {
-				return err
+		lastOp := s.LastOp
+		for i, el := range op.Operations {
+			if err := s.perform(el, capture); err != nil {
+				// a batch is applied either fully or not at all
+				for j := i - 1; j >= 0; j-- {
+					if rollbackErr := s.rollback(op.Operations[j]); rollbackErr != nil {
+						return fmt.Errorf("could not rollback partially applied batch: %v (after %w)", rollbackErr, &BatchError{Index: i, Operation: el, Err: err})
+					}
+				}
+				s.LastOp = lastOp
+				return &BatchError{Index: i, Operation: el, Err: err}
 			}
 		}
 		return nil
@@ -84,14 +210,73 @@ func (s *State) perform(operation Operation) error {
 	}
 }
 
-func (s *State) rollback(operation Operation) error {
+// capture remembers the value the operation is about to overwrite
+func (s *StateOf[T]) capture(operation Operation) {
+	switch op := operation.(type) {
+	case *OpUpdateOf[T]:
+		if op.Position >= 0 && op.Position < s.array.Size() {
+			op.PreviousValue = s.array.Get(op.Position)
+		}
+	case *OpDeleteOf[T]:
+		if op.Position >= 0 && op.Position < s.array.Size() {
+			op.PreviousValue = s.array.Get(op.Position)
+		}
+	case *OpAdd:
+		if op.Position >= 0 && op.Position < s.array.Size() {
+			op.PreviousValue, _ = any(s.array.Get(op.Position)).(int32)
+		}
+	case *OpMoveOf[T]:
+		if op.From >= 0 && op.From < s.array.Size() {
+			op.Value = s.array.Get(op.From)
+		}
+	case *OpInsertSortedOf[T]:
+		op.Position = s.upperBound(op.Value)
+	case *OpUpdateSortedOf[T]:
+		if op.Position >= 0 && op.Position < s.array.Size() {
+			op.PreviousValue = s.array.Get(op.Position)
+			// the element itself is taken out before being put back
+			if op.To = s.upperBound(op.Value); op.To > op.Position {
+				op.To--
+			}
+		}
+	case *OpDeleteText:
+		if op.Position >= 0 && op.Length >= 0 && op.Position+op.Length <= s.array.Size() {
+			if runes, ok := any(s.array.Range(op.Position, op.Position+op.Length)).([]rune); ok {
+				op.PreviousText = string(runes)
+			}
+		}
+	}
+}
+
+func (s *StateOf[T]) rollback(operation Operation) error {
 	switch op := operation.(type) {
-	case *OpInsert:
+	case *OpInsertOf[T]:
 		return s.delete(op.Position)
-	case *OpUpdate:
+	case *OpUpdateOf[T]:
 		return s.update(op.Position, op.PreviousValue)
-	case *OpDelete:
+	case *OpDeleteOf[T]:
 		return s.insert(op.Position, op.PreviousValue)
+	case *OpCompareAndSetOf[T]:
+		return s.update(op.Position, op.Expected)
+	case *OpAdd:
+		if op.Delta == 0 {
+			return nil
+		}
+		previous, ok := any(op.PreviousValue).(T)
+		if !ok {
+			return fmt.Errorf("could not rollback %v: elements are not int32", op)
+		}
+		return s.update(op.Position, previous)
+	case *OpMoveOf[T]:
+		return s.move(op.To, op.From)
+	case *OpInsertSortedOf[T]:
+		return s.delete(op.Position)
+	case *OpUpdateSortedOf[T]:
+		return s.updateSorted(op.To, op.Position, op.PreviousValue)
+	case *OpInsertText:
+		return s.deleteText(op.Position, op.Length())
+	case *OpDeleteText:
+		return s.insertText(op.Position, op.PreviousText)
 	case *OpBatch:
 		for i := len(op.Operations) - 1; i >= 0; i-- {
 			if err := s.rollback(op.Operations[i]); err != nil {
@@ -104,52 +289,443 @@ func (s *State) rollback(operation Operation) error {
 	}
 }
 
-func (s *State) insert(pos int, value int32) error {
+func (s *StateOf[T]) insert(pos int, value T) error {
 	if pos < 0 || pos > s.array.Size() {
 		return fmt.Errorf("could not insert: pos must be within bounds 0 <= %d <= %d", pos, s.array.Size())
 	}
-	s.array.Insert(pos, value)
+	s.insertAt(pos, value)
 	return nil
 }
 
-func (s *State) update(pos int, value int32) error {
+func (s *StateOf[T]) update(pos int, value T) error {
 	if pos < 0 || pos >= s.array.Size() {
 		return fmt.Errorf("could not update: pos must be within bounds 0 <= %d < %d", pos, s.array.Size())
 	}
-	s.array.Update(pos, value)
+	s.setAt(pos, value)
 	return nil
 }
 
-func (s *State) delete(pos int) error {
+func (s *StateOf[T]) delete(pos int) error {
 	if pos < 0 || pos >= s.array.Size() {
 		return fmt.Errorf("could not delete: pos must be within bounds 0 <= %d < %d", pos, s.array.Size())
 	}
-	s.array.Delete(pos)
+	s.deleteAt(pos)
+	return nil
+}
+
+func (s *StateOf[T]) compareAndSet(pos int, expected, value T) error {
+	if pos < 0 || pos >= s.array.Size() {
+		return fmt.Errorf("could not compare and set: pos must be within bounds 0 <= %d < %d", pos, s.array.Size())
+	}
+	if actual := s.array.Get(pos); actual != expected {
+		return &ConditionFailedErrorOf[T]{Position: pos, Expected: expected, Actual: actual}
+	}
+	s.setAt(pos, value)
+	return nil
+}
+
+func (s *StateOf[T]) add(pos int, delta int32, overflow OverflowPolicy) error {
+	if delta == 0 {
+		return nil
+	}
+	if pos < 0 || pos >= s.array.Size() {
+		return fmt.Errorf("could not add: pos must be within bounds 0 <= %d < %d", pos, s.array.Size())
+	}
+	current, ok := any(s.array.Get(pos)).(int32)
+	if !ok {
+		return fmt.Errorf("could not add: elements are not int32")
+	}
+	value, ok := added(current, delta, overflow)
+	if !ok {
+		return fmt.Errorf("could not add: %d + %d overflows int32", current, delta)
+	}
+	s.setAt(pos, any(value).(T))
 	return nil
 }
 
-func (s *State) Get(pos int) (int32, error) {
+// added returns the sum under the overflow policy, or false if the policy rejects it
+func added(current, delta int32, overflow OverflowPolicy) (int32, bool) {
+	value := int64(current) + int64(delta)
+	if value > math.MaxInt32 || value < math.MinInt32 {
+		switch overflow {
+		case OverflowSaturate:
+			if value > math.MaxInt32 {
+				value = math.MaxInt32
+			} else {
+				value = math.MinInt32
+			}
+		case OverflowReject:
+			return 0, false
+		}
+	}
+	return int32(value), true
+}
+
+// move places the element at position from so that it ends up at position to; from == to is a no-op
+func (s *StateOf[T]) move(from, to int) error {
+	if from == to {
+		return nil
+	}
+	if from < 0 || from >= s.array.Size() || to < 0 || to >= s.array.Size() {
+		return fmt.Errorf("could not move: positions must be within bounds 0 <= %d, %d < %d", from, to, s.array.Size())
+	}
+	s.insertAt(to, s.deleteAt(from))
+	return nil
+}
+
+// updateSorted takes the element at position from out and puts the value at position to instead
+func (s *StateOf[T]) updateSorted(from, to int, value T) error {
+	if from < 0 || from >= s.array.Size() || to < 0 || to >= s.array.Size() {
+		return fmt.Errorf("could not update sorted: positions must be within bounds 0 <= %d, %d < %d", from, to, s.array.Size())
+	}
+	s.deleteAt(from)
+	s.insertAt(to, value)
+	return nil
+}
+
+// insertText inserts the runes of the text at the position, that needs the elements to be int32
+func (s *StateOf[T]) insertText(pos int, text string) error {
+	if pos < 0 || pos > s.array.Size() {
+		return fmt.Errorf("could not insert text: pos must be within bounds 0 <= %d <= %d", pos, s.array.Size())
+	}
+	values, ok := any([]rune(text)).([]T)
+	if !ok {
+		return fmt.Errorf("could not insert text: elements are not int32")
+	}
+	s.insertRange(pos, values)
+	return nil
+}
+
+func (s *StateOf[T]) deleteText(pos, length int) error {
+	if pos < 0 || length < 0 || pos+length > s.array.Size() {
+		return fmt.Errorf("could not delete text: range [%d, %d) must be within bounds [0, %d)", pos, pos+length, s.array.Size())
+	}
+	if _, ok := any(s.array).(util.SequenceOf[rune]); !ok {
+		return fmt.Errorf("could not delete text: elements are not int32")
+	}
+	s.deleteRange(pos, pos+length)
+	return nil
+}
+
+// insertRange inserts the values at once, unless the index or the number of descents has to be kept up to date
+func (s *StateOf[T]) insertRange(pos int, values []T) {
+	if s.index == nil && !s.sorted {
+		s.array.InsertRange(pos, values)
+		return
+	}
+	for i, value := range values {
+		s.insertAt(pos+i, value)
+	}
+}
+
+// deleteRange removes the elements in [from, to) at once, unless the index or the number of descents has to be kept up to date
+func (s *StateOf[T]) deleteRange(from, to int) {
+	if s.index == nil && !s.sorted {
+		s.array.DeleteRange(from, to)
+		return
+	}
+	for pos := to - 1; pos >= from; pos-- {
+		s.deleteAt(pos)
+	}
+}
+
+// insertAt inserts the value at the position, keeping the index and the number of descents up to date
+func (s *StateOf[T]) insertAt(pos int, value T) {
+	if s.sorted {
+		s.descents -= s.descent(pos - 1)
+	}
+	s.array.Insert(pos, value)
+	if s.index != nil {
+		s.index.insert(s.array, pos, value)
+	}
+	if s.sorted {
+		s.descents += s.descent(pos-1) + s.descent(pos)
+	}
+}
+
+// setAt replaces the element at the position, keeping the index and the number of descents up to date
+func (s *StateOf[T]) setAt(pos int, value T) {
+	if s.sorted {
+		s.descents -= s.descent(pos-1) + s.descent(pos)
+	}
+	if s.index != nil {
+		s.index.update(pos, s.array.Get(pos), value)
+	}
+	s.array.Update(pos, value)
+	if s.sorted {
+		s.descents += s.descent(pos-1) + s.descent(pos)
+	}
+}
+
+// deleteAt removes the element at the position, keeping the index and the number of descents up to date, and returns it
+func (s *StateOf[T]) deleteAt(pos int) T {
+	if s.sorted {
+		s.descents -= s.descent(pos-1) + s.descent(pos)
+	}
+	value := s.array.Get(pos)
+	s.array.Delete(pos)
+	if s.index != nil {
+		s.index.delete(s.array, pos, value)
+	}
+	if s.sorted {
+		s.descents += s.descent(pos - 1)
+	}
+	return value
+}
+
+// descent returns 1 if the elements at the position and right after it are out of order, 0 otherwise
+func (s *StateOf[T]) descent(pos int) int {
+	if pos < 0 || pos+1 >= s.array.Size() || s.array.Codec().Compare(s.array.Get(pos), s.array.Get(pos+1)) <= 0 {
+		return 0
+	}
+	return 1
+}
+
+// lowerBound returns the first position of the sorted array holding an element not less than the value
+func (s *StateOf[T]) lowerBound(value T) int {
+	return sort.Search(s.array.Size(), func(pos int) bool {
+		return s.array.Codec().Compare(s.array.Get(pos), value) >= 0
+	})
+}
+
+// upperBound returns the first position of the sorted array holding an element greater than the value
+func (s *StateOf[T]) upperBound(value T) int {
+	return sort.Search(s.array.Size(), func(pos int) bool {
+		return s.array.Codec().Compare(s.array.Get(pos), value) > 0
+	})
+}
+
+func (s *StateOf[T]) Get(pos int) (T, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	if pos < 0 || pos >= s.array.Size() {
-		return 0, fmt.Errorf("could not get: pos must be non-negative and must not exceed current length")
+		var zero T
+		return zero, fmt.Errorf("could not get: pos must be non-negative and must not exceed current length")
+	}
+	return s.array.Get(pos), util.Err(s.array)
+}
+
+// Range returns a copy of the elements in [from, to)
+func (s *StateOf[T]) Range(from, to int) ([]T, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if from < 0 || to > s.array.Size() || from > to {
+		return nil, fmt.Errorf("could not get range: [%d, %d) must be within bounds [0, %d)", from, to, s.array.Size())
+	}
+	return s.array.Range(from, to), util.Err(s.array)
+}
+
+// RangeSum returns the sum of the elements in [from, to); only the elements of Summable codecs could be summed up
+func (s *StateOf[T]) RangeSum(from, to int) (int64, error) {
+	if _, ok := s.array.Codec().(util.Summable[T]); !ok {
+		return 0, fmt.Errorf("could not get sum: elements of %T could not be summed up", s.array.Codec())
+	}
+	aggregate, err := s.aggregate(from, to, "sum")
+	return aggregate.Sum, err
+}
+
+// RangeMin returns the minimal element in [from, to), that must not be empty
+func (s *StateOf[T]) RangeMin(from, to int) (T, error) {
+	aggregate, err := s.aggregate(from, to, "min")
+	if err == nil && aggregate.Count == 0 {
+		return aggregate.Min, fmt.Errorf("could not get min: range [%d, %d) is empty", from, to)
+	}
+	return aggregate.Min, err
+}
+
+// RangeMax returns the maximal element in [from, to), that must not be empty
+func (s *StateOf[T]) RangeMax(from, to int) (T, error) {
+	aggregate, err := s.aggregate(from, to, "max")
+	if err == nil && aggregate.Count == 0 {
+		return aggregate.Max, fmt.Errorf("could not get max: range [%d, %d) is empty", from, to)
+	}
+	return aggregate.Max, err
+}
+
+func (s *StateOf[T]) aggregate(from, to int, name string) (util.AggregateOf[T], error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if from < 0 || to > s.array.Size() || from > to {
+		return util.AggregateOf[T]{}, fmt.Errorf("could not get %s: [%d, %d) must be within bounds [0, %d)", name, from, to, s.array.Size())
 	}
-	return s.array.Get(pos), nil
+	return s.array.Aggregate(from, to), util.Err(s.array)
 }
 
-func (s *State) Size() int {
+func (s *StateOf[T]) Size() int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	return s.array.Size()
 }
 
-func (s *State) Set(array []int32) {
+// Checksum returns the hash of the array, that is cheap to get and does not depend on the way it is stored
+func (s *StateOf[T]) Checksum() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.array.Hash()
+}
+
+// MerkleTree returns the tree over the first size elements, see util.MerkleTree. Its nodes are hashed when asked for,
+// so the state must not be modified while the tree is in use.
+func (s *StateOf[T]) MerkleTree(size, leafSize int) *util.MerkleTree {
+	return util.NewMerkleTreeOf(s.array, size, leafSize)
+}
+
+// Replace replaces the elements in [from, to) with the values
+func (s *StateOf[T]) Replace(from, to int, values []T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if from < 0 || to > s.array.Size() || from > to {
+		return fmt.Errorf("could not replace range: [%d, %d) must be within bounds [0, %d)", from, to, s.array.Size())
+	}
+	s.deleteRange(from, to)
+	s.insertRange(from, values)
+	return nil
+}
+
+func (s *StateOf[T]) Set(array []T) {
 	s.mutex.Lock()
-	s.array.Set(array, 10)
+	s.array.Set(array)
+	if s.index != nil {
+		s.index.build(s.array)
+	}
+	if s.sorted {
+		s.countDescents()
+	}
+	s.mutex.Unlock()
+}
+
+// EnableSortedMode makes the state keep the array sorted: operations that would break the order are rejected,
+// while OpInsertSorted and OpUpdateSorted place elements where they belong. The array must be sorted already.
+func (s *StateOf[T]) EnableSortedMode() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sorted = true
+	if s.countDescents(); s.descents > 0 {
+		s.sorted, s.descents = false, 0
+		return fmt.Errorf("could not enable sorted mode: %w", ErrOrderViolated)
+	}
+	return nil
+}
+
+// Sorted tells whether the state is in the sorted mode
+func (s *StateOf[T]) Sorted() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sorted
+}
+
+func (s *StateOf[T]) countDescents() {
+	s.descents = 0
+	codec := s.array.Codec()
+	var previous T
+	s.array.Iterate(0, s.array.Size(), func(pos int, value T) bool {
+		if pos > 0 && codec.Compare(value, previous) < 0 {
+			s.descents++
+		}
+		previous = value
+		return true
+	})
+}
+
+// Search finds the value in the sorted array with binary search, returning the first position holding it, or the
+// one it would be inserted at, and whether it is there
+func (s *StateOf[T]) Search(value T) (int, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pos := s.lowerBound(value)
+	return pos, pos < s.array.Size() && s.array.Get(pos) == value
+}
+
+// EnableIndex makes the state maintain the index of values, so that they are found without scanning the array
+func (s *StateOf[T]) EnableIndex() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.index == nil {
+		s.index = newValueIndex(s.array)
+	}
+}
+
+func (s *StateOf[T]) DisableIndex() {
+	s.mutex.Lock()
+	s.index = nil
 	s.mutex.Unlock()
 }
 
-func (s *State) Copy() []int32 {
+// IndexOf returns the first position of the value or -1 if there is none; without the index the array is scanned,
+// unless it is sorted
+func (s *StateOf[T]) IndexOf(value T) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.index != nil {
+		return s.index.indexOf(s.array, value)
+	}
+	if s.sorted {
+		if pos := s.lowerBound(value); pos < s.array.Size() && s.array.Get(pos) == value {
+			return pos
+		}
+		return -1
+	}
+	result := -1
+	s.array.Iterate(0, s.array.Size(), func(pos int, element T) bool {
+		if element == value {
+			result = pos
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+func (s *StateOf[T]) Contains(value T) bool {
+	return s.IndexOf(value) >= 0
+}
+
+// CountOf returns the number of occurrences of the value; without the index the array is scanned, unless it is sorted
+func (s *StateOf[T]) CountOf(value T) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.index != nil {
+		return s.index.countOf(value)
+	}
+	if s.sorted {
+		return s.upperBound(value) - s.lowerBound(value)
+	}
+	count := 0
+	s.array.Iterate(0, s.array.Size(), func(_ int, element T) bool {
+		if element == value {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// Flush writes modifications to the storage if the elements are kept outside of memory
+func (s *StateOf[T]) Flush() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if persistent, ok := s.array.(util.PersistentOf[T]); ok {
+		return persistent.Flush()
+	}
+	return nil
+}
+
+// Close releases the storage if the elements are kept outside of memory
+func (s *StateOf[T]) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if persistent, ok := s.array.(util.PersistentOf[T]); ok {
+		return persistent.Close()
+	}
+	return nil
+}
+
+// Codec returns the codec the elements are compared, hashed and serialized with
+func (s *StateOf[T]) Codec() util.Codec[T] {
+	return s.array.Codec()
+}
+
+func (s *StateOf[T]) Copy() []T {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	return s.array.GetAll()
@@ -2,16 +2,75 @@ package state
 
 import "fmt"
 
-type OperationalTransformer struct {}
+// OperationalTransformerOf transforms operations on elements of type T
+type OperationalTransformerOf[T comparable] struct{}
 
-func (ot *OperationalTransformer) transform(committed Operation, transformable *Operation, state *State) (bool, error) {
+type OperationalTransformer = OperationalTransformerOf[int32]
+
+// Transform adjusts the operation, created at some version, so that it could be applied after all the committed ones
+func (ot *OperationalTransformerOf[T]) Transform(committed []Operation, transformable *Operation, state *StateOf[T]) (bool, error) {
+	transformed := false
+	for _, op := range committed {
+		if res, err := ot.transform(op, transformable, state); err != nil {
+			return false, err
+		} else {
+			transformed = transformed || res
+		}
+	}
+	return transformed, nil
+}
+
+// TransformReverted transforms the inverse of some operation past the committed one like Transform does, unless the
+// committed operation has touched the element the inverse targets; the reason of the conflict is returned then
+func (ot *OperationalTransformerOf[T]) TransformReverted(committed Operation, inverse *Operation, state *StateOf[T]) (string, error) {
+	if batch, ok := committed.(*OpBatch); ok {
+		for _, op := range batch.Operations {
+			if reason, err := ot.TransformReverted(op, inverse, state); reason != "" || err != nil {
+				return reason, err
+			}
+		}
+		return "", nil
+	}
+	if reason := conflict[T](committed, *inverse); reason != "" {
+		return reason, nil
+	}
+	_, err := ot.transform(committed, inverse, state)
+	return "", err
+}
+
+func (ot *OperationalTransformerOf[T]) transform(committed Operation, transformable *Operation, state *StateOf[T]) (bool, error) {
 	switch c := committed.(type) {
-	case *OpInsert:
+	case *OpInsertOf[T]:
 		return ot._transform(transformable, state, c.Position, 1)
-	case *OpUpdate:
+	case *OpUpdateOf[T]:
+		return false, nil
+	case *OpCompareAndSetOf[T]:
 		return false, nil
-	case *OpDelete:
+	case *OpAdd:
+		// additions commute with each other and never shift positions
+		return false, nil
+	case *OpDeleteOf[T]:
 		return ot._transform(transformable, state, c.Position, -1)
+	case *OpMoveOf[T]:
+		if c.From == c.To {
+			return false, nil
+		}
+		return ot._move(transformable, c.From, c.To)
+	case *OpInsertSortedOf[T]:
+		return ot._transform(transformable, state, c.Position, 1)
+	case *OpUpdateSortedOf[T]:
+		// the element is taken out and put back where its new value belongs
+		if c.Position == c.To {
+			return false, nil
+		}
+		return ot._move(transformable, c.Position, c.To)
+	case *OpInsertText:
+		return ot._transform(transformable, state, c.Position, c.Length())
+	case *OpDeleteText:
+		if c.Length == 0 {
+			return false, nil
+		}
+		return ot._delete(transformable, state, c.Position, c.Length)
 	case *OpBatch:
 		result := false
 		for _, op := range c.Operations {
@@ -27,9 +86,9 @@ func (ot *OperationalTransformer) transform(committed Operation, transformable *
 	}
 }
 
-func (ot *OperationalTransformer) _transform(operation *Operation, state *State, pos, delta int) (bool, error) {
+func (ot *OperationalTransformerOf[T]) _transform(operation *Operation, state *StateOf[T], pos, delta int) (bool, error) {
 	switch o := (*operation).(type) {
-	case *OpInsert:
+	case *OpInsertOf[T]:
 		if o.Position >= pos {
 			o.Position += delta
 			if o.Position < 0 {
@@ -39,7 +98,51 @@ func (ot *OperationalTransformer) _transform(operation *Operation, state *State,
 			}
 			return true, nil
 		}
-	case *OpUpdate:
+	case *OpUpdateOf[T]:
+		if delta < 0 && o.Position == pos {
+			// the element is gone, so its new value would end up in place of another one
+			*operation = &OpBatch{}
+			return true, nil
+		}
+		if o.Position >= pos {
+			o.Position += delta
+			if o.Position < 0 {
+				o.Position = 0
+			} else if o.Position >= state.array.Size() {
+				o.Position = state.array.Size() - 1
+			}
+			return true, nil
+		}
+	case *OpDeleteOf[T]:
+		if o.Position >= pos {
+			o.Position += delta
+			if o.Position < 0 {
+				o.Position = 0
+			} else if o.Position >= state.array.Size() {
+				o.Position = state.array.Size() - 1
+			}
+			return true, nil
+		}
+	case *OpCompareAndSetOf[T]:
+		if delta < 0 && o.Position == pos {
+			// there is nothing left to compare with
+			return false, fmt.Errorf("could not compare and set at pos %d: %w", o.Position, ErrElementDeleted)
+		}
+		if o.Position >= pos {
+			o.Position += delta
+			if o.Position < 0 {
+				o.Position = 0
+			} else if o.Position >= state.array.Size() {
+				o.Position = state.array.Size() - 1
+			}
+			return true, nil
+		}
+	case *OpAdd:
+		if delta < 0 && o.Position == pos {
+			// the counter is gone, so nothing is left to add to
+			o.Delta = 0
+			return true, nil
+		}
 		if o.Position >= pos {
 			o.Position += delta
 			if o.Position < 0 {
@@ -49,7 +152,67 @@ func (ot *OperationalTransformer) _transform(operation *Operation, state *State,
 			}
 			return true, nil
 		}
-	case *OpDelete:
+	case *OpMoveOf[T]:
+		if o.From == o.To {
+			return false, nil
+		}
+		if delta < 0 && o.From == pos {
+			// the element being moved is gone, so there is nothing left to move
+			o.From, o.To = 0, 0
+			return true, nil
+		}
+		result := false
+		if o.From >= pos {
+			o.From += delta
+			result = true
+		}
+		if o.To >= pos {
+			o.To += delta
+			result = true
+		}
+		if state.array.Size() == 0 {
+			// nothing is left to move within an empty array
+			o.From, o.To = 0, 0
+			return true, nil
+		}
+		if o.To < 0 {
+			o.To = 0
+		} else if o.To >= state.array.Size() {
+			o.To = state.array.Size() - 1
+		}
+		return result, nil
+	case *OpInsertSortedOf[T]:
+		// the position is chosen when the operation is applied
+		return false, nil
+	case *OpInsertText:
+		if o.Position >= pos {
+			o.Position += delta
+			if o.Position < 0 {
+				o.Position = 0
+			} else if o.Position > state.array.Size() {
+				o.Position = state.array.Size()
+			}
+			return true, nil
+		}
+	case *OpDeleteText:
+		if delta < 0 {
+			return ot._delete(operation, state, pos, -delta)
+		}
+		if o.Position >= pos {
+			o.Position += delta
+			return true, nil
+		}
+		if pos < o.Position+o.Length {
+			// the text inserted into the range survives, so the range is split around it
+			*operation = splitDeletion(o, pos-o.Position, delta)
+			return true, nil
+		}
+	case *OpUpdateSortedOf[T]:
+		if delta < 0 && o.Position == pos {
+			// the element is gone, so its new value would end up in place of another one
+			*operation = &OpBatch{}
+			return true, nil
+		}
 		if o.Position >= pos {
 			o.Position += delta
 			if o.Position < 0 {
@@ -61,8 +224,8 @@ func (ot *OperationalTransformer) _transform(operation *Operation, state *State,
 		}
 	case *OpBatch:
 		result := false
-		for _, op := range o.Operations {
-			if res, err := ot._transform(&op, state, pos, delta); err != nil {
+		for i := range o.Operations {
+			if res, err := ot._transform(&o.Operations[i], state, pos, delta); err != nil {
 				return false, err
 			} else {
 				result = result || res
@@ -74,3 +237,318 @@ func (ot *OperationalTransformer) _transform(operation *Operation, state *State,
 	}
 	return false, nil
 }
+
+// _move transforms operation against the committed move of the element at position from to position to.
+// Concurrent moves of the same element are resolved in favour of the one committed last.
+func (ot *OperationalTransformerOf[T]) _move(operation *Operation, from, to int) (bool, error) {
+	switch o := (*operation).(type) {
+	case *OpInsertOf[T]:
+		pos := o.Position
+		if pos > from {
+			pos--
+		}
+		if pos > to {
+			pos++
+		}
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpUpdateOf[T]:
+		pos := movedPosition(o.Position, from, to)
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpDeleteOf[T]:
+		pos := movedPosition(o.Position, from, to)
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpCompareAndSetOf[T]:
+		pos := movedPosition(o.Position, from, to)
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpAdd:
+		pos := movedPosition(o.Position, from, to)
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpMoveOf[T]:
+		if o.From == o.To {
+			return false, nil
+		}
+		newFrom := movedPosition(o.From, from, to)
+		newTo := o.To
+		if o.From != from {
+			newTo = shiftedPosition(o.To, from, to)
+		}
+		result := newFrom != o.From || newTo != o.To
+		o.From, o.To = newFrom, newTo
+		return result, nil
+	case *OpInsertSortedOf[T]:
+		return false, nil
+	case *OpUpdateSortedOf[T]:
+		pos := movedPosition(o.Position, from, to)
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpInsertText:
+		pos := o.Position
+		if pos > from {
+			pos--
+		}
+		if pos > to {
+			pos++
+		}
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpDeleteText:
+		// text is never moved by text clients, so the range just follows the elements before it
+		pos := o.Position
+		if pos > from {
+			pos--
+		}
+		if pos > to {
+			pos++
+		}
+		result := pos != o.Position
+		o.Position = pos
+		return result, nil
+	case *OpBatch:
+		result := false
+		for i := range o.Operations {
+			if res, err := ot._move(&o.Operations[i], from, to); err != nil {
+				return false, err
+			} else {
+				result = result || res
+			}
+		}
+		return result, nil
+	default:
+		return false, fmt.Errorf("unknown operation: %T", o)
+	}
+}
+
+// _delete transforms operation against the committed deletion of the elements in [from, from+length). Operations on
+// the deleted elements turn into no-ops, apart from conditions, that fail as there is nothing left to check.
+func (ot *OperationalTransformerOf[T]) _delete(operation *Operation, state *StateOf[T], from, length int) (bool, error) {
+	switch o := (*operation).(type) {
+	case *OpInsertOf[T]:
+		return shiftInsertion(&o.Position, state.array.Size(), from, length), nil
+	case *OpUpdateOf[T]:
+		if o.Position >= from && o.Position < from+length {
+			*operation = &OpBatch{}
+			return true, nil
+		}
+		return shiftElement(&o.Position, state.array.Size(), from, length), nil
+	case *OpDeleteOf[T]:
+		if o.Position >= from && o.Position < from+length {
+			*operation = &OpBatch{}
+			return true, nil
+		}
+		return shiftElement(&o.Position, state.array.Size(), from, length), nil
+	case *OpCompareAndSetOf[T]:
+		if o.Position >= from && o.Position < from+length {
+			return false, fmt.Errorf("could not compare and set at pos %d: %w", o.Position, ErrElementDeleted)
+		}
+		return shiftElement(&o.Position, state.array.Size(), from, length), nil
+	case *OpAdd:
+		if o.Position >= from && o.Position < from+length {
+			o.Delta = 0
+			return true, nil
+		}
+		return shiftElement(&o.Position, state.array.Size(), from, length), nil
+	case *OpMoveOf[T]:
+		if o.From == o.To {
+			return false, nil
+		}
+		if o.From >= from && o.From < from+length {
+			// the element being moved is gone, so there is nothing left to move
+			o.From, o.To = 0, 0
+			return true, nil
+		}
+		if state.array.Size() == 0 {
+			o.From, o.To = 0, 0
+			return true, nil
+		}
+		result := shiftElement(&o.From, state.array.Size(), from, length)
+		if shiftInsertion(&o.To, state.array.Size(), from, length) {
+			result = true
+		}
+		if o.To >= state.array.Size() {
+			o.To = state.array.Size() - 1
+		}
+		return result, nil
+	case *OpInsertSortedOf[T]:
+		return false, nil
+	case *OpUpdateSortedOf[T]:
+		if o.Position >= from && o.Position < from+length {
+			*operation = &OpBatch{}
+			return true, nil
+		}
+		return shiftElement(&o.Position, state.array.Size(), from, length), nil
+	case *OpInsertText:
+		return shiftInsertion(&o.Position, state.array.Size(), from, length), nil
+	case *OpDeleteText:
+		end, deletedEnd := o.Position+o.Length, from+length
+		overlapFrom, overlapTo := o.Position, end
+		if from > overlapFrom {
+			overlapFrom = from
+		}
+		if deletedEnd < overlapTo {
+			overlapTo = deletedEnd
+		}
+		if overlapFrom >= overlapTo {
+			if o.Position >= deletedEnd {
+				o.Position -= length
+				return true, nil
+			}
+			return false, nil
+		}
+		// the runes deleted already are left out of the range
+		if runes := []rune(o.PreviousText); len(runes) == o.Length {
+			o.PreviousText = string(runes[:overlapFrom-o.Position]) + string(runes[overlapTo-o.Position:])
+		}
+		o.Length -= overlapTo - overlapFrom
+		if from < o.Position {
+			o.Position = from
+		}
+		return true, nil
+	case *OpBatch:
+		result := false
+		for i := range o.Operations {
+			if res, err := ot._delete(&o.Operations[i], state, from, length); err != nil {
+				return false, err
+			} else {
+				result = result || res
+			}
+		}
+		return result, nil
+	default:
+		return false, fmt.Errorf("unknown operation: %T", o)
+	}
+}
+
+// shiftInsertion moves the position to insert at past the deletion of the elements in [from, from+length),
+// keeping it within [0, size]; returns whether it has changed
+func shiftInsertion(pos *int, size, from, length int) bool {
+	previous := *pos
+	if *pos >= from+length {
+		*pos -= length
+	} else if *pos > from {
+		*pos = from
+	}
+	if *pos > size {
+		*pos = size
+	}
+	return *pos != previous
+}
+
+// shiftElement moves the position of an element past the deletion of the elements in [from, from+length) the same
+// way a deletion of a single element does, keeping it within [0, size); returns whether it has changed
+func shiftElement(pos *int, size, from, length int) bool {
+	previous := *pos
+	if *pos >= from+length {
+		*pos -= length
+	} else if *pos >= from {
+		*pos = from - 1
+	}
+	if *pos >= size {
+		*pos = size - 1
+	}
+	if *pos < 0 {
+		*pos = 0
+	}
+	return *pos != previous
+}
+
+// splitDeletion splits the deletion of the text around the given number of runes inserted at the offset into it
+func splitDeletion(op *OpDeleteText, offset, inserted int) Operation {
+	head := &OpDeleteText{Position: op.Position, Length: offset}
+	tail := &OpDeleteText{Position: op.Position + inserted, Length: op.Length - offset}
+	if runes := []rune(op.PreviousText); len(runes) == op.Length {
+		head.PreviousText, tail.PreviousText = string(runes[:offset]), string(runes[offset:])
+	}
+	return &OpBatch{Operations: []Operation{head, tail}}
+}
+
+// movedPosition returns where the element at pos ends up after the element at position from is moved to position to
+func movedPosition(pos, from, to int) int {
+	if pos == from {
+		return to
+	}
+	return shiftedPosition(pos, from, to)
+}
+
+// shiftedPosition returns how pos shifts when some element is taken out at position from and put back at position to
+func shiftedPosition(pos, from, to int) int {
+	if pos > from {
+		pos--
+	}
+	if pos >= to {
+		pos++
+	}
+	return pos
+}
+
+// conflict returns why the operation could not be applied meaningfully after the committed one, or an empty string if it could
+func conflict[T comparable](committed Operation, operation Operation) string {
+	if batch, ok := operation.(*OpBatch); ok {
+		for _, op := range batch.Operations {
+			if reason := conflict[T](committed, op); reason != "" {
+				return reason
+			}
+		}
+		return ""
+	}
+	target := -1
+	switch o := operation.(type) {
+	case *OpUpdateOf[T]:
+		target = o.Position
+	case *OpDeleteOf[T]:
+		target = o.Position
+	case *OpCompareAndSetOf[T]:
+		target = o.Position
+	case *OpAdd:
+		if o.Delta != 0 {
+			target = o.Position
+		}
+	case *OpMoveOf[T]:
+		if o.From != o.To {
+			target = o.From
+		}
+	case *OpUpdateSortedOf[T]:
+		target = o.Position
+	}
+	if target < 0 {
+		return ""
+	}
+	switch c := committed.(type) {
+	case *OpDeleteOf[T]:
+		if c.Position == target {
+			return "element was deleted"
+		}
+	case *OpUpdateOf[T]:
+		if c.Position == target {
+			return "element was modified"
+		}
+	case *OpCompareAndSetOf[T]:
+		if c.Position == target {
+			return "element was modified"
+		}
+	case *OpAdd:
+		if c.Delta != 0 && c.Position == target {
+			return "element was modified"
+		}
+	case *OpUpdateSortedOf[T]:
+		if c.Position == target {
+			return "element was modified"
+		}
+	case *OpDeleteText:
+		if target >= c.Position && target < c.Position+c.Length {
+			return "element was deleted"
+		}
+	}
+	return ""
+}
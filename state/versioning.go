@@ -1,65 +1,140 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
-type Versioner struct {
-	State          *State
-	transformer    *OperationalTransformer
+// RevertConflictError is returned when an operation could not be reverted because some later one touched the same element
+type RevertConflictError struct {
+	Version            int
+	Operation          Operation
+	ConflictingVersion int
+	Conflicting        Operation
+	Reason             string
+}
+
+func (e *RevertConflictError) Error() string {
+	return fmt.Sprintf("could not revert %v at version %d: %s by %v at version %d", e.Operation, e.Version, e.Reason, e.Conflicting, e.ConflictingVersion)
+}
+
+// VersionerOf keeps the history of operations applied to the state of elements of type T
+type VersionerOf[T comparable] struct {
+	State          *StateOf[T]
+	transformer    *OperationalTransformerOf[T]
 	minVersion     int
 	maxHistorySize int
+	retained       map[int]int
+	retainLimit    int
 	history        []Operation
+	metadata       []Metadata
+	deduplicator   *deduplicator
 	mutex          sync.RWMutex
 }
 
+type Versioner = VersionerOf[int32]
+
 var emptyHistory []Operation
 
-func NewVersioner(state *State, maxHistorySize int) *Versioner {
-	return &Versioner{
+// defaultRetainFactor is how many times longer than usual history could get because of the retained versions
+const defaultRetainFactor = 10
+
+// ErrHistoryTrimmed is returned for versions, whose operations have been dropped from history already
+var ErrHistoryTrimmed = errors.New("version is no longer in history")
+
+func NewVersioner[T comparable](state *StateOf[T], maxHistorySize int) *VersionerOf[T] {
+	return &VersionerOf[T]{
 		State: state,
-		transformer: &OperationalTransformer{},
+		transformer: &OperationalTransformerOf[T]{},
 		maxHistorySize: maxHistorySize,
+		retained: make(map[int]int),
+		retainLimit: maxHistorySize * defaultRetainFactor,
 		history: make([]Operation, 0),
+		metadata: make([]Metadata, 0),
+		deduplicator: newDeduplicator(DefaultDeduplicationWindow),
 		mutex: sync.RWMutex{},
 	}
 }
 
-// returns: whether to rollback, diff, error
-func (v *Versioner) ProcessOperation(version int, operation Operation) (bool, []Operation, error) {
+// SetDeduplicationWindow defines how long retries of committed client operations are recognized
+func (v *VersionerOf[T]) SetDeduplicationWindow(window time.Duration) {
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
+	v.deduplicator.window = window
+}
+
+// returns: whether to rollback, diff, metadata of every operation since the version (the processed one included), error.
+// Retries of an already committed operation, recognized by its client and operation ids, get the original result.
+func (v *VersionerOf[T]) ProcessOperation(version int, operation Operation, metadata Metadata) (bool, []Operation, []Metadata, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if committedVersion, ok := v.deduplicator.lookup(metadata); ok {
+		return v.replay(version, committedVersion)
+	}
 	operations, err := v.getOperationsSince(version)
 	if err != nil {
-		return true, nil, err
-	}
-	transformed := false
-	for _, op := range operations {
-		if res, err := v.transformer.transform(op, &operation, v.State); err != nil {
-			return true, nil, err
-		} else {
-			transformed = transformed || res
-		}
+		return true, nil, nil, err
+	}
+	if _, err := v.transformer.Transform(operations, &operation, v.State); err != nil {
+		return true, nil, nil, err
 	}
 	if err := v.State.Perform(operation); err != nil {
-		return true, nil, err
+		return true, nil, nil, err
 	}
-	v.newOperation(operation)
+	// taken before the new operation pushes the oldest one out of the full history
+	metadatas := v.getMetadataSince(version)
+	v.newOperation(operation, metadata)
+	committed := v.metadata[len(v.metadata)-1]
+	v.deduplicator.remember(committed)
+	metadatas = append(metadatas, committed)
 	if len(operations) == 0 {
-		return false, nil, nil
+		return false, nil, metadatas, nil
 	}
 	operations = append(operations, operation)
-	return true, operations, nil
+	return true, operations, metadatas, nil
+}
+
+// replay rebuilds the result ProcessOperation returned for the operation sent at the version and committed at committedVersion
+func (v *VersionerOf[T]) replay(version, committedVersion int) (bool, []Operation, []Metadata, error) {
+	if version > committedVersion || version < v.minVersion {
+		return true, nil, nil, fmt.Errorf("could not replay operation committed at version %d: version %d is not retained", committedVersion, version)
+	}
+	metadata := make([]Metadata, committedVersion-version+1)
+	copy(metadata, v.metadata[version-v.minVersion:])
+	if version == committedVersion {
+		return false, nil, metadata, nil
+	}
+	operations := make([]Operation, committedVersion-version+1)
+	copy(operations, v.history[version-v.minVersion:])
+	return true, operations, metadata, nil
 }
 
-func (v *Versioner) GetOperationsSince(version int) ([]Operation, error) {
+func (v *VersionerOf[T]) GetOperationsSince(version int) ([]Operation, error) {
 	v.mutex.RLock()
 	defer v.mutex.RUnlock()
 	return v.getOperationsSince(version)
 }
 
-func (v *Versioner) getOperationsSince(version int) ([]Operation, error) {
+// GetHistorySince returns operations committed since the version along with their metadata
+func (v *VersionerOf[T]) GetHistorySince(version int) ([]Operation, []Metadata, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	operations, err := v.getOperationsSince(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return operations, v.getMetadataSince(version), nil
+}
+
+func (v *VersionerOf[T]) getMetadataSince(version int) []Metadata {
+	result := make([]Metadata, v.getCurrentVersion()-version)
+	copy(result, v.metadata[version-v.minVersion:])
+	return result
+}
+
+func (v *VersionerOf[T]) getOperationsSince(version int) ([]Operation, error) {
 	currentVersion := v.getCurrentVersion()
 	if version == currentVersion {
 		return emptyHistory, nil
@@ -68,7 +143,7 @@ func (v *Versioner) getOperationsSince(version int) ([]Operation, error) {
 		return nil, fmt.Errorf("received negative version: %d", version)
 	}
 	if version < v.minVersion {
-		return nil, fmt.Errorf("received version %d, that is below the minimal one: %d", version, v.minVersion)
+		return nil, fmt.Errorf("received version %d, that is below the minimal one: %d: %w", version, v.minVersion, ErrHistoryTrimmed)
 	}
 	if version > currentVersion {
 		return nil, fmt.Errorf("received version from the future: %d, whilst current one is %d", version, currentVersion)
@@ -84,20 +159,193 @@ func (v *Versioner) getOperationsSince(version int) ([]Operation, error) {
 	return result, nil
 }
 
-func (v *Versioner) GetCurrentState() (int, []int32) {
+// GetCurrentState returns the current version along with a copy of the array, that is made without holding any locks
+func (v *VersionerOf[T]) GetCurrentState() (int, []T) {
+	version, snapshot := v.Snapshot()
+	defer snapshot.Release()
+	return version, snapshot.Array()
+}
+
+// Snapshot returns the current version along with the snapshot of the state at it
+func (v *VersionerOf[T]) Snapshot() (int, *SnapshotOf[T]) {
 	v.mutex.RLock()
 	defer v.mutex.RUnlock()
-	return v.getCurrentVersion(), v.State.Copy()
+	return v.getCurrentVersion(), v.State.Snapshot()
 }
 
-func (v *Versioner) getCurrentVersion() int {
-	return v.minVersion + len(v.history)
+// GetRange returns the current version along with the elements in [from, to)
+func (v *VersionerOf[T]) GetRange(from, to int) (int, []T, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	array, err := v.State.Range(from, to)
+	if err != nil {
+		return 0, nil, err
+	}
+	return v.getCurrentVersion(), array, nil
 }
 
-func (v *Versioner) newOperation(op Operation) {
-	if len(v.history) == v.maxHistorySize {
+// StateAt rebuilds the array as it was at the given version by rolling the current one back through history,
+// so it works for any version that is still retained
+func (v *VersionerOf[T]) StateAt(version int) ([]T, error) {
+	v.mutex.RLock()
+	operations, err := v.getOperationsSince(version)
+	if err != nil {
+		v.mutex.RUnlock()
+		return nil, err
+	}
+	past := &StateOf[T]{array: v.State.Snapshot().array}
+	v.mutex.RUnlock()
+	defer past.array.Release()
+	for i := len(operations) - 1; i >= 0; i-- {
+		if err := past.rollback(operations[i]); err != nil {
+			return nil, fmt.Errorf("could not rollback %v while rebuilding version %d: %w", operations[i], version, err)
+		}
+	}
+	return past.array.GetAll(), nil
+}
+
+// Restore commits a new operation that turns the current array into the given one, so that clients
+// converge to it through the usual diffs; returns the version the array is restored at
+func (v *VersionerOf[T]) Restore(array []T) (int, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	operation := Diff(v.State.Copy(), array)
+	if len(operation.Operations) == 0 {
+		return v.getCurrentVersion(), nil
+	}
+	if err := v.State.Perform(operation); err != nil {
+		return 0, err
+	}
+	v.newOperation(operation, Metadata{ClientID: SystemClientID})
+	return v.getCurrentVersion(), nil
+}
+
+// RetainSnapshot returns the current version along with the snapshot of the state at it, like Snapshot does, and keeps
+// the history back to the version until it is released, so that the array could be reverted to it. History is still
+// trimmed once it gets longer than the retention limit.
+func (v *VersionerOf[T]) RetainSnapshot() (int, *SnapshotOf[T]) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	version := v.getCurrentVersion()
+	v.retained[version]++
+	return version, v.State.Snapshot()
+}
+
+// Release lets the history retained back to the version be trimmed
+func (v *VersionerOf[T]) Release(version int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.retained[version]--; v.retained[version] <= 0 {
+		delete(v.retained, version)
+	}
+	v.trim()
+}
+
+// SetRetentionLimit defines how many operations history could keep because of the retained versions
+func (v *VersionerOf[T]) SetRetentionLimit(operations int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.retainLimit = operations
+	v.trim()
+}
+
+// RevertTo commits the inverse of every operation committed since the version, so that the array gets back to what
+// it was then without being copied and clients converge to it through the usual diffs; returns the version of the revert
+func (v *VersionerOf[T]) RevertTo(version int) (int, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	operations, err := v.getOperationsSince(version)
+	if err != nil {
+		return 0, err
+	}
+	if len(operations) == 0 {
+		return v.getCurrentVersion(), nil
+	}
+	inverse := make([]Operation, len(operations))
+	for i, op := range operations {
+		inverse[len(operations)-1-i] = op.Inverse()
+	}
+	operation := &OpBatch{Operations: inverse}
+	if err := v.State.Perform(operation); err != nil {
+		return 0, fmt.Errorf("could not revert to version %d: %w", version, err)
+	}
+	v.newOperation(operation, Metadata{ClientID: SystemClientID})
+	return v.getCurrentVersion(), nil
+}
+
+// Revert commits the inverse of the operation that was applied at the given version, transformed past everything
+// committed after it; returns the version of the revert or *RevertConflictError if later operations touched its target
+func (v *VersionerOf[T]) Revert(version int) (int, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	operations, err := v.getOperationsSince(version)
+	if err != nil {
+		return 0, err
+	}
+	if len(operations) == 0 {
+		return 0, fmt.Errorf("there is no operation at version %d yet", version)
+	}
+	inverse := operations[0].Inverse()
+	if v.State.Sorted() {
+		inverse = SortedFormOf[T](inverse)
+	}
+	for i, op := range operations[1:] {
+		if reason, err := v.transformer.TransformReverted(op, &inverse, v.State); err != nil {
+			return 0, err
+		} else if reason != "" {
+			return 0, &RevertConflictError{Version: version, Operation: operations[0], ConflictingVersion: version + 1 + i, Conflicting: op, Reason: reason}
+		}
+	}
+	if err := v.State.Perform(inverse); err != nil {
+		return 0, fmt.Errorf("could not apply inverse of %v: %w", operations[0], err)
+	}
+	v.newOperation(inverse, Metadata{ClientID: SystemClientID})
+	return v.getCurrentVersion(), nil
+}
+
+// Blame returns metadata of the operation that produced every element in [from, to) of the current array, tracking
+// positions through all the later operations; Version is -1 for elements produced before the retained history.
+// The current version is returned as well.
+func (v *VersionerOf[T]) Blame(from, to int) (int, []Metadata, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if from < 0 || to > v.State.Size() || from > to {
+		return 0, nil, fmt.Errorf("could not blame: range [%d, %d) must be within bounds [0, %d)", from, to, v.State.Size())
+	}
+	result := make([]Metadata, to-from)
+	for i := range result {
+		result[i] = Metadata{Version: -1}
+		pos := i + from
+		for j := len(v.history) - 1; j >= 0; j-- {
+			var produced bool
+			if pos, produced = traceBack[T](v.history[j], pos); produced {
+				result[i] = v.metadata[j]
+				break
+			}
+		}
+	}
+	return v.getCurrentVersion(), result, nil
+}
+
+// trim drops the oldest operations, so that there is room for a new one, unless a retained version needs them
+func (v *VersionerOf[T]) trim() {
+	for len(v.history) >= v.maxHistorySize && (v.retained[v.minVersion] == 0 || len(v.history) >= v.retainLimit) {
 		v.minVersion++
 		v.history = v.history[1:]
+		v.metadata = v.metadata[1:]
 	}
+}
+
+func (v *VersionerOf[T]) getCurrentVersion() int {
+	return v.minVersion + len(v.history)
+}
+
+// newOperation appends the operation to history, completing its metadata with the commit time, version and checksum
+func (v *VersionerOf[T]) newOperation(op Operation, metadata Metadata) {
+	v.trim()
+	metadata.Timestamp = time.Now()
+	metadata.Version = v.getCurrentVersion()
+	metadata.Checksum = v.State.Checksum()
 	v.history = append(v.history, op)
+	v.metadata = append(v.metadata, metadata)
 }
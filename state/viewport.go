@@ -0,0 +1,121 @@
+package state
+
+type (
+	// ViewportOf is the range of positions [From, From+Size) a client replicates. It sticks to the elements inside:
+	// inserts and deletes before it shift it, the ones inside make it grow or shrink.
+	ViewportOf[T comparable] struct {
+		From int
+		Size int
+	}
+
+	// Projection is what an operation looks like from a viewport: the operations within it relative to its start,
+	// and the shift of the viewport caused by everything that happened before it
+	Projection struct {
+		Operations []Operation
+		Shift      int
+	}
+
+	Viewport = ViewportOf[int32]
+)
+
+// Project moves the viewport past the operation and returns the projection of the operation
+func (v *ViewportOf[T]) Project(operation Operation) Projection {
+	projection := Projection{}
+	v.project(operation, &projection)
+	return projection
+}
+
+// Apply applies the projection to the state holding the elements of the viewport and moves the viewport accordingly
+func (v *ViewportOf[T]) Apply(projection Projection, state *StateOf[T]) error {
+	if err := state.PerformMany(projection.Operations, 0); err != nil {
+		return err
+	}
+	v.From += projection.Shift
+	v.Size = state.Size()
+	return nil
+}
+
+// Contains tells whether there is an element at pos inside of the viewport
+func (v *ViewportOf[T]) Contains(pos int) bool {
+	return pos >= v.From && pos < v.From+v.Size
+}
+
+func (v *ViewportOf[T]) project(operation Operation, projection *Projection) {
+	switch op := operation.(type) {
+	case *OpInsertOf[T]:
+		if op.Position < v.From {
+			v.From++
+			projection.Shift++
+		} else if op.Position <= v.From+v.Size {
+			projection.Operations = append(projection.Operations, &OpInsertOf[T]{Position: op.Position - v.From, Value: op.Value})
+			v.Size++
+		}
+	case *OpDeleteOf[T]:
+		if op.Position < v.From {
+			v.From--
+			projection.Shift--
+		} else if v.Contains(op.Position) {
+			projection.Operations = append(projection.Operations, &OpDeleteOf[T]{Position: op.Position - v.From, PreviousValue: op.PreviousValue})
+			v.Size--
+		}
+	case *OpUpdateOf[T]:
+		if v.Contains(op.Position) {
+			projection.Operations = append(projection.Operations, &OpUpdateOf[T]{Position: op.Position - v.From, Value: op.Value, PreviousValue: op.PreviousValue})
+		}
+	case *OpCompareAndSetOf[T]:
+		if v.Contains(op.Position) {
+			projection.Operations = append(projection.Operations, &OpCompareAndSetOf[T]{Position: op.Position - v.From, Expected: op.Expected, Value: op.Value})
+		}
+	case *OpAdd:
+		if op.Delta != 0 && v.Contains(op.Position) {
+			projection.Operations = append(projection.Operations, &OpAdd{Position: op.Position - v.From, Delta: op.Delta, Overflow: op.Overflow, PreviousValue: op.PreviousValue})
+		}
+	case *OpMoveOf[T]:
+		if op.From != op.To {
+			v.project(&OpDeleteOf[T]{Position: op.From, PreviousValue: op.Value}, projection)
+			v.project(&OpInsertOf[T]{Position: op.To, Value: op.Value}, projection)
+		}
+	case *OpInsertSortedOf[T]:
+		v.project(&OpInsertOf[T]{Position: op.Position, Value: op.Value}, projection)
+	case *OpUpdateSortedOf[T]:
+		v.project(&OpDeleteOf[T]{Position: op.Position, PreviousValue: op.PreviousValue}, projection)
+		v.project(&OpInsertOf[T]{Position: op.To, Value: op.Value}, projection)
+	case *OpInsertText:
+		length := op.Length()
+		if op.Position < v.From {
+			v.From += length
+			projection.Shift += length
+		} else if op.Position <= v.From+v.Size {
+			projection.Operations = append(projection.Operations, &OpInsertText{Position: op.Position - v.From, Text: op.Text})
+			v.Size += length
+		}
+	case *OpDeleteText:
+		// the part of the range inside of the viewport is projected, the part before it shifts the viewport
+		from, to := op.Position, op.Position+op.Length
+		if from < v.From {
+			from = v.From
+		}
+		if to > v.From+v.Size {
+			to = v.From + v.Size
+		}
+		if from < to {
+			deleted := &OpDeleteText{Position: from - v.From, Length: to - from}
+			if runes := []rune(op.PreviousText); len(runes) == op.Length {
+				deleted.PreviousText = string(runes[from-op.Position : to-op.Position])
+			}
+			projection.Operations = append(projection.Operations, deleted)
+			v.Size -= to - from
+		}
+		if before := v.From - op.Position; before > 0 {
+			if before > op.Length {
+				before = op.Length
+			}
+			v.From -= before
+			projection.Shift -= before
+		}
+	case *OpBatch:
+		for _, o := range op.Operations {
+			v.project(o, projection)
+		}
+	}
+}
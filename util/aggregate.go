@@ -0,0 +1,69 @@
+package util
+
+// AggregateOf summarizes a range of elements; Min and Max are meaningless when Count is zero,
+// Sum is zero unless the codec is Summable
+type AggregateOf[T comparable] struct {
+	Count int
+	Sum   int64
+	Min   T
+	Max   T
+}
+
+type Aggregate = AggregateOf[int32]
+
+func (e *elements[T]) aggregateOf(array []T) AggregateOf[T] {
+	var result AggregateOf[T]
+	for _, value := range array {
+		result = e.added(result, value)
+	}
+	return result
+}
+
+// combine returns the aggregate of both ranges together
+func (e *elements[T]) combine(a, b AggregateOf[T]) AggregateOf[T] {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+	a.Count += b.Count
+	a.Sum += b.Sum
+	if e.codec.Compare(b.Min, a.Min) < 0 {
+		a.Min = b.Min
+	}
+	if e.codec.Compare(b.Max, a.Max) > 0 {
+		a.Max = b.Max
+	}
+	return a
+}
+
+func (e *elements[T]) added(a AggregateOf[T], value T) AggregateOf[T] {
+	return e.combine(a, AggregateOf[T]{Count: 1, Sum: e.sum(value), Min: value, Max: value})
+}
+
+// removed returns the aggregate of the array, that the value has just been removed from;
+// the array is scanned only if the value was the minimum or the maximum
+func (e *elements[T]) removed(a AggregateOf[T], value T, array []T) AggregateOf[T] {
+	if value == a.Min || value == a.Max {
+		return e.aggregateOf(array)
+	}
+	a.Count--
+	a.Sum -= e.sum(value)
+	return a
+}
+
+// updated returns the aggregate of the array, where the previous value has just been replaced with the value
+func (e *elements[T]) updated(a AggregateOf[T], previous, value T, array []T) AggregateOf[T] {
+	if previous == a.Min || previous == a.Max {
+		return e.aggregateOf(array)
+	}
+	a.Sum += e.sum(value) - e.sum(previous)
+	if e.codec.Compare(value, a.Min) < 0 {
+		a.Min = value
+	}
+	if e.codec.Compare(value, a.Max) > 0 {
+		a.Max = value
+	}
+	return a
+}
@@ -5,179 +5,409 @@ import (
 	"math"
 )
 
+// minBlockSize keeps blocks of small arrays from degenerating into single elements
+const minBlockSize = 16
+
 type (
-	block struct {
-		array       []int32
-		size        int
-		startingPos int
+	block[T comparable] struct {
+		array      []T
+		hash       uint64
+		aggregate  AggregateOf[T]
+		generation uint64
 	}
 
-	BlockedArray struct {
-		blocks    []*block
-		size      int
-		blockSize int
+	// BlockedArrayOf keeps elements in blocks of about √n of them. A block is split in halves once it grows twice
+	// as big as that and is merged with a neighbour once it shrinks to half of it, so the array never gets rebuilt.
+	// Positions the blocks start at are kept in a Fenwick tree, so that finding an element takes O(log n), and hashes
+	// of the blocks are combined in a segment tree, so that the hash of the whole array is kept up to date in O(log n).
+	// Snapshots share blocks with the array: the ones of other generations get copied before being modified.
+	BlockedArrayOf[T comparable] struct {
+		elements   *elements[T]
+		blocks     []*block[T]
+		offsets    Fenwick
+		hashes     hashTree
+		size       int
+		blockSize  int
+		generation uint64
+		// whether blocks, offsets and hashes themselves are shared with a snapshot
+		shared bool
 	}
+
+	BlockedArray = BlockedArrayOf[int32]
 )
 
-func NewBlockedArray(array []int32, blocks int) *BlockedArray {
-	blockedArray := &BlockedArray{}
-	blockedArray.Set(array, blocks)
+func NewBlockedArray(array []int32) *BlockedArray {
+	return NewBlockedArrayOf(Int32Codec, array)
+}
+
+func NewBlockedArrayOf[T comparable](codec Codec[T], array []T) *BlockedArrayOf[T] {
+	blockedArray := &BlockedArrayOf[T]{elements: newElements(codec), generation: newGeneration()}
+	blockedArray.Set(array)
 	return blockedArray
 }
 
-func (ba *BlockedArray) Set(array []int32, blocks int) {
+func (ba *BlockedArrayOf[T]) Set(array []T) {
+	ba.size = len(array)
+	ba.resize()
+	ba.shared = false
 	if len(array) == 0 {
+		// keeping a single empty block, so that there is a place to insert into
+		ba.blocks = []*block[T]{ba.newBlock(nil)}
+		ba.rebuildOffsets()
 		return
 	}
-	ba.size = len(array)
-	ba.blockSize = int(math.Ceil(float64(ba.size) / float64(blocks)))
-	if ba.blockSize * blocks - len(array) >= ba.blockSize {
-		blocks = 1 + len(array) / ba.blockSize
-		if len(array) % ba.blockSize == 0 {
-			blocks--
+	ba.blocks = make([]*block[T], 0, (len(array)+ba.blockSize-1)/ba.blockSize)
+	for from := 0; from < len(array); from += ba.blockSize {
+		to := from + ba.blockSize
+		if to > len(array) {
+			to = len(array)
 		}
+		ba.blocks = append(ba.blocks, ba.newBlock(array[from:to]))
 	}
-	ba.blocks = make([]*block, blocks)
-	blockIndex, j := -1, ba.blockSize-1
-	for i, value := range array {
-		j++
-		if j == ba.blockSize {
-			j = 0
-			blockIndex++
-			ba.blocks[blockIndex] = ba.newBlock(i)
-		}
-		ba.blocks[blockIndex].array[j] = value
-		ba.blocks[blockIndex].size++
-	}
-	if blockIndex != blocks - 1 {
-		panic(fmt.Errorf("internal error"))
-	}
+	ba.rebuildOffsets()
 }
 
-func (ba *BlockedArray) Insert(pos int, value int32) {
+func (ba *BlockedArrayOf[T]) Insert(pos int, value T) {
 	if pos > ba.size {
 		panic(fmt.Errorf("could not insert element at position %d: the size is only %d", pos, ba.size))
 	}
-	blockIndex := ba.getBlockIndex(pos)
-	if blockIndex == len(ba.blocks) {
-		ba.blocks[blockIndex] = ba.newBlock(pos)
-	}
-	block := ba.blocks[blockIndex]
-	inBlockPos := block.getInBlockPosition(pos)
-	if inBlockPos == len(block.array) {
-		block.array = append(block.array, value)
-	} else {
-		for i := block.size; i > inBlockPos; i-- {
-			if i == len(block.array) {
-				block.array = append(block.array, block.array[i - 1])
-			} else {
-				block.array[i] = block.array[i - 1]
-			}
-		}
-		block.array[inBlockPos] = value
-	}
-	block.size++
+	ba.own()
+	blockIndex, inBlockPos := ba.locate(pos)
+	block := ba.ownBlock(blockIndex)
+	suffix := block.hashSince(ba.elements, inBlockPos)
+	block.hash += ba.elements.mix(value)*power(inBlockPos) + suffix*(hashBase-1)
+	block.array = append(block.array, value)
+	copy(block.array[inBlockPos+1:], block.array[inBlockPos:])
+	block.array[inBlockPos] = value
+	block.aggregate = ba.elements.added(block.aggregate, value)
 	ba.size++
-	for i := blockIndex + 1; i < len(ba.blocks); i++ {
-		ba.blocks[i].startingPos++
-	}
-	ba.checkAndRebalance()
+	ba.offsets.Add(blockIndex, 1)
+	ba.hashes.set(blockIndex, block.hash, len(block.array))
+	ba.resize()
+	ba.balance(blockIndex)
 }
 
-func (ba *BlockedArray) Delete(pos int) {
+func (ba *BlockedArrayOf[T]) Delete(pos int) {
 	if pos >= ba.size {
 		panic(fmt.Errorf("could not delete element at position %d: the size is only %d", pos, ba.size))
 	}
-	blockIndex := ba.getBlockIndex(pos)
+	ba.own()
+	blockIndex, inBlockPos := ba.locate(pos)
+	block := ba.ownBlock(blockIndex)
+	suffix := block.hashSince(ba.elements, inBlockPos+1)
+	removed := block.array[inBlockPos]
+	block.hash += suffix*hashBaseInverse - suffix - ba.elements.mix(removed)*power(inBlockPos)
+	copy(block.array[inBlockPos:], block.array[inBlockPos+1:])
+	block.array = block.array[:len(block.array)-1]
+	block.aggregate = ba.elements.removed(block.aggregate, removed, block.array)
+	ba.size--
+	ba.offsets.Add(blockIndex, -1)
+	ba.hashes.set(blockIndex, block.hash, len(block.array))
+	ba.resize()
+	ba.balance(blockIndex)
+}
+
+func (ba *BlockedArrayOf[T]) InsertRange(pos int, values []T) {
+	if pos > ba.size {
+		panic(fmt.Errorf("could not insert elements at position %d: the size is only %d", pos, ba.size))
+	}
+	if len(values) == 0 {
+		return
+	}
+	blockIndex, inBlockPos := ba.locate(pos)
 	block := ba.blocks[blockIndex]
-	inBlockPos := block.getInBlockPosition(pos)
-	for i := inBlockPos; i < block.size-1; i++ {
-		block.array[i] = block.array[i+1]
+	array := make([]T, 0, len(block.array)+len(values))
+	array = append(append(append(array, block.array[:inBlockPos]...), values...), block.array[inBlockPos:]...)
+	ba.size += len(values)
+	ba.resize()
+	ba.replace(blockIndex, blockIndex+1, array)
+}
+
+func (ba *BlockedArrayOf[T]) DeleteRange(from, to int) {
+	if from < 0 || to > ba.size || from > to {
+		panic(fmt.Errorf("could not delete range [%d, %d): the size is only %d", from, to, ba.size))
 	}
-	block.size--
-	ba.size--
-	for i := blockIndex + 1; i < len(ba.blocks); i++ {
-		ba.blocks[i].startingPos--
+	if from == to {
+		return
 	}
-	ba.checkAndRebalance()
+	fromBlock, fromPos := ba.locate(from)
+	toBlock, toPos := ba.locate(to - 1)
+	array := make([]T, 0, fromPos+len(ba.blocks[toBlock].array)-toPos-1)
+	array = append(append(array, ba.blocks[fromBlock].array[:fromPos]...), ba.blocks[toBlock].array[toPos+1:]...)
+	ba.size -= to - from
+	ba.resize()
+	ba.replace(fromBlock, toBlock+1, array)
 }
 
-func (ba *BlockedArray) Update(pos int, value int32) {
+func (ba *BlockedArrayOf[T]) Update(pos int, value T) {
 	if pos >= ba.size {
 		panic(fmt.Errorf("could not update element at position %d: the size is only %d", pos, ba.size))
 	}
-	block := ba.blocks[ba.getBlockIndex(pos)]
-	block.array[block.getInBlockPosition(pos)] = value
+	ba.own()
+	blockIndex, inBlockPos := ba.locate(pos)
+	block := ba.ownBlock(blockIndex)
+	previous := block.array[inBlockPos]
+	block.hash += (ba.elements.mix(value) - ba.elements.mix(previous)) * power(inBlockPos)
+	block.array[inBlockPos] = value
+	block.aggregate = ba.elements.updated(block.aggregate, previous, value, block.array)
+	ba.hashes.set(blockIndex, block.hash, len(block.array))
 }
 
-func (ba *BlockedArray) Get(pos int) int32 {
+func (ba *BlockedArrayOf[T]) Get(pos int) T {
 	if pos >= ba.size {
 		panic(fmt.Errorf("could not get element at position %d: the size is only %d", pos, ba.size))
 	}
-	block := ba.blocks[ba.getBlockIndex(pos)]
-	return block.array[block.getInBlockPosition(pos)]
+	blockIndex, inBlockPos := ba.locate(pos)
+	return ba.blocks[blockIndex].array[inBlockPos]
 }
 
-func (ba *BlockedArray) GetAll() []int32 {
-	array := make([]int32, ba.size)
+func (ba *BlockedArrayOf[T]) GetAll() []T {
+	array := make([]T, ba.size)
 	i := 0
 	for _, block := range ba.blocks {
-		for j := 0; j < block.size; j++ {
-			array[i] = block.array[j]
-			i++
-		}
+		i += copy(array[i:], block.array)
 	}
 	return array
 }
 
-func (ba *BlockedArray) Size() int {
-	return ba.size
+// Range returns a copy of the elements in [from, to)
+func (ba *BlockedArrayOf[T]) Range(from, to int) []T {
+	if from < 0 || to > ba.size || from > to {
+		panic(fmt.Errorf("could not get range [%d, %d): the size is only %d", from, to, ba.size))
+	}
+	array := make([]T, to-from)
+	blockIndex, inBlockPos := ba.locate(from)
+	for i := 0; i < len(array); blockIndex, inBlockPos = blockIndex+1, 0 {
+		i += copy(array[i:], ba.blocks[blockIndex].array[inBlockPos:])
+	}
+	return array
 }
 
-func (ba *BlockedArray) checkAndRebalance() {
-	if len(ba.blocks) == 0 {
+func (ba *BlockedArrayOf[T]) Iterate(from, to int, f func(pos int, value T) bool) {
+	if from >= to {
 		return
 	}
+	blockIndex, inBlockPos := ba.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		for _, value := range ba.blocks[blockIndex].array[inBlockPos:] {
+			if pos == to || !f(pos, value) {
+				return
+			}
+			pos++
+		}
+	}
+}
 
-	min, max := 1_000_000_000, -1
-	for _, block := range ba.blocks {
-		if block.size < min {
-			min = block.size
+// Snapshot returns a copy of the array in O(1): the blocks are shared until either of the two modifies them
+func (ba *BlockedArrayOf[T]) Snapshot() SequenceOf[T] {
+	snapshot := *ba
+	snapshot.generation, snapshot.shared = newGeneration(), true
+	ba.generation, ba.shared = newGeneration(), true
+	return &snapshot
+}
+
+// Release does nothing: blocks shared with snapshots are garbage collected
+func (ba *BlockedArrayOf[T]) Release() {
+}
+
+// Aggregate summarizes the elements in [from, to) scanning only the blocks it covers partially
+func (ba *BlockedArrayOf[T]) Aggregate(from, to int) AggregateOf[T] {
+	if from < 0 || to > ba.size || from > to {
+		panic(fmt.Errorf("could not aggregate range [%d, %d): the size is only %d", from, to, ba.size))
+	}
+	var result AggregateOf[T]
+	blockIndex, inBlockPos := ba.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		block := ba.blocks[blockIndex]
+		if inBlockPos == 0 && pos+len(block.array) <= to {
+			result = ba.elements.combine(result, block.aggregate)
+			pos += len(block.array)
+			continue
 		}
-		if block.size > max {
-			max = block.size
+		end := len(block.array)
+		if end-inBlockPos > to-pos {
+			end = inBlockPos + to - pos
 		}
+		result = ba.elements.combine(result, ba.elements.aggregateOf(block.array[inBlockPos:end]))
+		pos += end - inBlockPos
 	}
-	if max > (min << 1) {
-		ba.rebalance()
+	return result
+}
+
+func (ba *BlockedArrayOf[T]) Codec() Codec[T] {
+	return ba.elements.codec
+}
+
+// Hash returns the polynomial hash of the whole array, see util.HashOf
+func (ba *BlockedArrayOf[T]) Hash() uint64 {
+	return ba.hashes.root()
+}
+
+// HashRange combines hashes of the blocks within the range, hashing only the elements of the blocks it covers partially
+func (ba *BlockedArrayOf[T]) HashRange(from, to int) uint64 {
+	if from < 0 || to > ba.size || from > to {
+		panic(fmt.Errorf("could not hash range [%d, %d): the size is only %d", from, to, ba.size))
 	}
+	hash := uint64(0)
+	if from == to {
+		return hash
+	}
+	blockIndex, inBlockPos := ba.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		block := ba.blocks[blockIndex]
+		if inBlockPos == 0 && pos+len(block.array) <= to {
+			hash += block.hash * power(pos-from)
+			pos += len(block.array)
+			continue
+		}
+		end := len(block.array)
+		if end-inBlockPos > to-pos {
+			end = inBlockPos + to - pos
+		}
+		hash += ba.elements.hash(block.array[inBlockPos:end]) * power(pos-from)
+		pos += end - inBlockPos
+	}
+	return hash
+}
+
+func (ba *BlockedArrayOf[T]) Size() int {
+	return ba.size
 }
 
-func (ba *BlockedArray) rebalance() {
-	ba.Set(ba.GetAll(), len(ba.blocks))
+// resize follows the target block size after the number of elements; blocks get adjusted to it as they are touched
+func (ba *BlockedArrayOf[T]) resize() {
+	ba.blockSize = int(math.Sqrt(float64(ba.size)))
+	if ba.blockSize < minBlockSize {
+		ba.blockSize = minBlockSize
+	}
 }
 
-func (ba *BlockedArray) getBlockIndex(pos int) int {
-	if len(ba.blocks) == 0 {
-		panic(fmt.Errorf("there are no blocks"))
+// balance splits the block if it is too big and merges it with a neighbour if it is too small
+func (ba *BlockedArrayOf[T]) balance(blockIndex int) {
+	if len(ba.blocks[blockIndex].array) > ba.blockSize<<1 {
+		ba.split(blockIndex)
+		return
 	}
-	if len(ba.blocks) == 1 {
-		return 0
+	if len(ba.blocks[blockIndex].array) < ba.blockSize>>1 && len(ba.blocks) > 1 {
+		if blockIndex == len(ba.blocks)-1 {
+			blockIndex--
+		}
+		ba.merge(blockIndex)
+		if len(ba.blocks[blockIndex].array) > ba.blockSize<<1 {
+			ba.split(blockIndex)
+		}
 	}
-	// TODO: binary search?
-	for i := 1; i < len(ba.blocks); i++ {
-		from, to := ba.blocks[i - 1].startingPos, ba.blocks[i].startingPos
-		if pos >= from && pos < to {
-			return i - 1
+}
+
+// replace puts blocks made of the array in place of the blocks in [from, to)
+func (ba *BlockedArrayOf[T]) replace(from, to int, array []T) {
+	blocks := make([]*block[T], 0, len(ba.blocks)-(to-from)+len(array)/ba.blockSize+1)
+	blocks = append(blocks, ba.blocks[:from]...)
+	for start := 0; start < len(array); {
+		end := start + ba.blockSize
+		if len(array)-end < ba.blockSize>>1 {
+			// the remainder is too small for a block of its own
+			end = len(array)
 		}
+		blocks = append(blocks, ba.newBlock(array[start:end]))
+		start = end
+	}
+	added := len(blocks) - from
+	ba.blocks = append(blocks, ba.blocks[to:]...)
+	if len(ba.blocks) == 0 {
+		ba.blocks = []*block[T]{ba.newBlock(nil)}
+	}
+	ba.rebuildOffsets()
+	ba.shared = false
+	if added == 1 {
+		ba.balance(from)
+	}
+}
+
+// split replaces the block with its two halves
+func (ba *BlockedArrayOf[T]) split(blockIndex int) {
+	left := ba.ownBlock(blockIndex)
+	half := len(left.array) >> 1
+	right := ba.newBlock(left.array[half:])
+	left.array = left.array[:half]
+	left.recalculate(ba.elements)
+	ba.blocks = append(ba.blocks, nil)
+	copy(ba.blocks[blockIndex+2:], ba.blocks[blockIndex+1:])
+	ba.blocks[blockIndex+1] = right
+	// rebuilding the tree takes as long as moving the blocks does
+	ba.rebuildOffsets()
+}
+
+// merge appends the next block to the given one
+func (ba *BlockedArrayOf[T]) merge(blockIndex int) {
+	left, right := ba.ownBlock(blockIndex), ba.blocks[blockIndex+1]
+	left.hash += right.hash * power(len(left.array))
+	left.aggregate = ba.elements.combine(left.aggregate, right.aggregate)
+	left.array = append(left.array, right.array...)
+	copy(ba.blocks[blockIndex+1:], ba.blocks[blockIndex+2:])
+	ba.blocks[len(ba.blocks)-1] = nil
+	ba.blocks = ba.blocks[:len(ba.blocks)-1]
+	ba.rebuildOffsets()
+}
+
+// rebuildOffsets rebuilds both the offsets and the hashes of the blocks once the blocks themselves have changed
+func (ba *BlockedArrayOf[T]) rebuildOffsets() {
+	sizes := make([]int, len(ba.blocks))
+	for i, block := range ba.blocks {
+		sizes[i] = len(block.array)
+	}
+	ba.offsets = NewFenwick(sizes)
+	ba.hashes = newHashTree(len(ba.blocks), func(i int) (uint64, int) {
+		return ba.blocks[i].hash, len(ba.blocks[i].array)
+	})
+}
+
+// own copies blocks, offsets and hashes shared with a snapshot, so that they could be modified
+func (ba *BlockedArrayOf[T]) own() {
+	if !ba.shared {
+		return
+	}
+	ba.blocks = append(make([]*block[T], 0, len(ba.blocks)+1), ba.blocks...)
+	ba.offsets = append(Fenwick(nil), ba.offsets...)
+	ba.hashes = append(hashTree(nil), ba.hashes...)
+	ba.shared = false
+}
+
+// ownBlock returns the block after copying it if it belongs to another generation
+func (ba *BlockedArrayOf[T]) ownBlock(blockIndex int) *block[T] {
+	b := ba.blocks[blockIndex]
+	if b.generation != ba.generation {
+		b = &block[T]{array: append(make([]T, 0, len(b.array)+1), b.array...), hash: b.hash, aggregate: b.aggregate, generation: ba.generation}
+		ba.blocks[blockIndex] = b
+	}
+	return b
+}
+
+// newBlock creates a block of the current generation holding a copy of the array
+func (ba *BlockedArrayOf[T]) newBlock(array []T) *block[T] {
+	b := &block[T]{array: make([]T, len(array)), generation: ba.generation}
+	copy(b.array, array)
+	b.recalculate(ba.elements)
+	return b
+}
+
+// locate returns the index of the block containing the position and the position within it;
+// the position right after the last element is located at the end of the last block
+func (ba *BlockedArrayOf[T]) locate(pos int) (int, int) {
+	blockIndex, startingPos := ba.offsets.Search(pos)
+	if blockIndex == len(ba.blocks) {
+		blockIndex--
+		startingPos -= len(ba.blocks[blockIndex].array)
 	}
-	return len(ba.blocks) - 1
+	return blockIndex, pos - startingPos
 }
 
-func (ba *BlockedArray) newBlock(startingPos int) *block {
-	return &block{array: make([]int32, ba.blockSize), startingPos: startingPos}
+// hashSince returns the part of the block hash contributed by elements starting with the in-block position
+func (b *block[T]) hashSince(e *elements[T], inBlockPos int) uint64 {
+	return e.hash(b.array[inBlockPos:]) * power(inBlockPos)
 }
 
-func (b *block) getInBlockPosition(pos int) int {
-	return pos - b.startingPos
+func (b *block[T]) recalculate(e *elements[T]) {
+	b.hash = e.hash(b.array)
+	b.aggregate = e.aggregateOf(b.array)
 }
@@ -8,7 +8,7 @@ func TestArray(t *testing.T) {
 		realArray[i] = int32(i)
 	}
 
-	array := NewBlockedArray(realArray, 10)
+	array := NewBlockedArray(realArray)
 	t.Logf("%v", array.GetAll())
 
 	for i := 0; i < 10; i++ {
@@ -30,3 +30,137 @@ func TestArray(t *testing.T) {
 	array.Delete(15)
 	t.Logf("%v", array.GetAll())
 }
+
+func TestHash(t *testing.T) {
+	realArray := make([]int32, 50)
+	for i := 0; i < len(realArray); i++ {
+		realArray[i] = int32(i * 7)
+	}
+	array := NewBlockedArray(realArray)
+	check := func(action string) {
+		if expected, actual := Hash(array.GetAll()), array.Hash(); expected != actual {
+			t.Errorf("hash mismatch after %s: expected %x, got %x", action, expected, actual)
+		}
+	}
+	check("creation")
+	for i := 0; i < 30; i++ {
+		array.Insert((i*13)%(array.Size()+1), int32(-i))
+		check("insert")
+		array.Update((i*17)%array.Size(), int32(i*i))
+		check("update")
+		if i%2 == 0 {
+			array.Delete((i * 11) % array.Size())
+			check("delete")
+		}
+	}
+	if Hash([]int32{1, 2}) == Hash([]int32{2, 1}) {
+		t.Errorf("hash does not depend on order")
+	}
+}
+
+func TestBlockSizes(t *testing.T) {
+	expected := make([]int32, 0)
+	array := NewBlockedArray(expected)
+	for i := 0; i < 20000; i++ {
+		if i%3 == 2 && len(expected) > 0 {
+			pos := (i * 7919) % len(expected)
+			array.Delete(pos)
+			expected = append(expected[:pos], expected[pos+1:]...)
+		} else {
+			pos := (i * 104729) % (len(expected) + 1)
+			array.Insert(pos, int32(i))
+			expected = append(expected, 0)
+			copy(expected[pos+1:], expected[pos:])
+			expected[pos] = int32(i)
+		}
+	}
+	actual := array.GetAll()
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("element %d differs: expected %d, got %d", i, expected[i], actual[i])
+		}
+	}
+	if Hash(expected) != array.Hash() {
+		t.Errorf("hash mismatch")
+	}
+	for i, block := range array.blocks {
+		if len(block.array) > array.blockSize<<1 {
+			t.Errorf("block %d of %d elements exceeds twice the target size %d", i, len(block.array), array.blockSize)
+		}
+	}
+	if len(array.blocks) > 4*array.size/array.blockSize+1 {
+		t.Errorf("too many blocks: %d for %d elements", len(array.blocks), array.size)
+	}
+}
+
+func TestFenwick(t *testing.T) {
+	sizes := []int{3, 0, 5, 1, 7, 2, 4}
+	offsets := NewFenwick(sizes)
+	offsets.Add(1, 2)
+	sizes[1] += 2
+	start := 0
+	for i, size := range sizes {
+		if prefix := offsets.Prefix(i); prefix != start {
+			t.Errorf("block %d starts at %d instead of %d", i, prefix, start)
+		}
+		for pos := start; pos < start+size; pos++ {
+			if index, from := offsets.Search(pos); index != i || from != start {
+				t.Errorf("position %d found in block %d starting at %d instead of %d at %d", pos, index, from, i, start)
+			}
+		}
+		start += size
+	}
+	if index, _ := offsets.Search(start); index != len(sizes) {
+		t.Errorf("position after the last element found in block %d", index)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	blocks := [][]int32{{1, 2, 3}, {}, {4, 5, 6, 7, 8}, {9}, {10, 11}}
+	hashes := newHashTree(len(blocks), func(i int) (uint64, int) {
+		return Hash(blocks[i]), len(blocks[i])
+	})
+	blocks[1] = []int32{12, 13}
+	hashes.set(1, Hash(blocks[1]), len(blocks[1]))
+	var array []int32
+	for _, block := range blocks {
+		array = append(array, block...)
+	}
+	if hashes.root() != Hash(array) {
+		t.Errorf("combined hash of the blocks differs from the hash of %v", array)
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	array := make([]int32, 100)
+	for i := range array {
+		array[i] = int32(i)
+	}
+	tree := NewMerkleTree(NewBlockedArray(array), len(array), 8)
+	if tree.Depth() != 5 || tree.Width(4) != 13 {
+		t.Errorf("unexpected tree shape: depth %d, %d leaves", tree.Depth(), tree.Width(tree.Depth()-1))
+	}
+	if from, to := tree.Leaf(12); from != 96 || to != 100 {
+		t.Errorf("unexpected range of the last leaf: [%d, %d)", from, to)
+	}
+
+	modified := make([]int32, len(array))
+	copy(modified, array)
+	modified[42] = -1
+	other := NewMerkleTree(NewRope(modified), len(modified), 8)
+	if tree.Root() == other.Root() {
+		t.Errorf("root does not depend on the contents")
+	}
+	for level := 1; level < tree.Depth(); level++ {
+		for i := 0; i < tree.Width(level); i++ {
+			from, to := i<<(tree.Depth()-1-level)*8, (i+1)<<(tree.Depth()-1-level)*8
+			differs := tree.Node(level, i) != other.Node(level, i)
+			if differs != (from <= 42 && 42 < to) {
+				t.Errorf("node %d on level %d differs: %v", i, level, differs)
+			}
+		}
+	}
+	if truncated := NewMerkleTree(NewSlice(append(array, 1, 2, 3)), len(array), 8); truncated.Root() != tree.Root() {
+		t.Errorf("elements beyond the size were hashed")
+	}
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Codec is the hook defining how elements of a document are ordered, hashed and serialized.
+// Documents of int32 use Int32Codec; documents of other types, e.g. small structs, implement their own.
+type Codec[T comparable] interface {
+	Compare(a, b T) int
+	// Hash spreads the bits of the value, so that close values do not produce close hashes
+	Hash(value T) uint64
+	// Size returns the number of bytes every value is encoded with, or 0 if encodings differ in length
+	Size() int
+	// Append appends the encoding of the value to the buffer
+	Append(buffer []byte, value T) []byte
+	// Decode decodes the value at the beginning of the data, returning the number of bytes it took
+	Decode(data []byte) (T, int, error)
+}
+
+// Summable is implemented by codecs of the elements, that aggregates sum up; sums of the others are always zero
+type Summable[T comparable] interface {
+	Int64(value T) int64
+}
+
+var (
+	Int32Codec   Codec[int32]   = int32Codec{}
+	Int64Codec   Codec[int64]   = int64Codec{}
+	Float64Codec Codec[float64] = float64Codec{}
+	StringCodec  Codec[string]  = stringCodec{}
+)
+
+type (
+	int32Codec   struct{}
+	int64Codec   struct{}
+	float64Codec struct{}
+	stringCodec  struct{}
+)
+
+func (int32Codec) Compare(a, b int32) int {
+	return cmp.Compare(a, b)
+}
+
+func (int32Codec) Hash(value int32) uint64 {
+	return mix(uint64(uint32(value)))
+}
+
+func (int32Codec) Size() int {
+	return 4
+}
+
+func (int32Codec) Append(buffer []byte, value int32) []byte {
+	return binary.LittleEndian.AppendUint32(buffer, uint32(value))
+}
+
+func (int32Codec) Decode(data []byte) (int32, int, error) {
+	if len(data) < 4 {
+		return 0, 0, fmt.Errorf("could not decode int32 from %d bytes", len(data))
+	}
+	return int32(binary.LittleEndian.Uint32(data)), 4, nil
+}
+
+func (int32Codec) Int64(value int32) int64 {
+	return int64(value)
+}
+
+func (int64Codec) Compare(a, b int64) int {
+	return cmp.Compare(a, b)
+}
+
+func (int64Codec) Hash(value int64) uint64 {
+	return mix(uint64(value))
+}
+
+func (int64Codec) Size() int {
+	return 8
+}
+
+func (int64Codec) Append(buffer []byte, value int64) []byte {
+	return binary.LittleEndian.AppendUint64(buffer, uint64(value))
+}
+
+func (int64Codec) Decode(data []byte) (int64, int, error) {
+	if len(data) < 8 {
+		return 0, 0, fmt.Errorf("could not decode int64 from %d bytes", len(data))
+	}
+	return int64(binary.LittleEndian.Uint64(data)), 8, nil
+}
+
+// Int64 lets sums of int64 elements wrap around, as the elements themselves do
+func (int64Codec) Int64(value int64) int64 {
+	return value
+}
+
+func (float64Codec) Compare(a, b float64) int {
+	return cmp.Compare(a, b)
+}
+
+func (float64Codec) Hash(value float64) uint64 {
+	return mix(math.Float64bits(value))
+}
+
+func (float64Codec) Size() int {
+	return 8
+}
+
+func (float64Codec) Append(buffer []byte, value float64) []byte {
+	return binary.LittleEndian.AppendUint64(buffer, math.Float64bits(value))
+}
+
+func (float64Codec) Decode(data []byte) (float64, int, error) {
+	if len(data) < 8 {
+		return 0, 0, fmt.Errorf("could not decode float64 from %d bytes", len(data))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+}
+
+func (stringCodec) Compare(a, b string) int {
+	return cmp.Compare(a, b)
+}
+
+func (stringCodec) Hash(value string) uint64 {
+	hash := uint64(len(value))
+	for i := 0; i < len(value); i++ {
+		hash = hash*hashBase + uint64(value[i])
+	}
+	return mix(hash)
+}
+
+func (stringCodec) Size() int {
+	return 0
+}
+
+// Append encodes the string prefixed with its length
+func (stringCodec) Append(buffer []byte, value string) []byte {
+	return append(binary.AppendUvarint(buffer, uint64(len(value))), value...)
+}
+
+func (stringCodec) Decode(data []byte) (string, int, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", 0, fmt.Errorf("could not decode string from %d bytes", len(data))
+	}
+	return string(data[n : n+int(length)]), n + int(length), nil
+}
+
+// Encode encodes all the values one after another
+func Encode[T comparable](codec Codec[T], values []T) []byte {
+	buffer := make([]byte, 0, len(values)*codec.Size())
+	for _, value := range values {
+		buffer = codec.Append(buffer, value)
+	}
+	return buffer
+}
+
+// Decode decodes all the values Encode encoded into the data
+func Decode[T comparable](codec Codec[T], data []byte) ([]T, error) {
+	var values []T
+	if size := codec.Size(); size > 0 {
+		values = make([]T, 0, len(data)/size)
+	}
+	for len(data) > 0 {
+		value, n, err := codec.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode element #%d: %w", len(values), err)
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// elements bundles the codec with everything sequences derive from it: hashes and aggregates
+type elements[T comparable] struct {
+	codec Codec[T]
+	sum   func(value T) int64
+}
+
+func newElements[T comparable](codec Codec[T]) *elements[T] {
+	e := &elements[T]{codec: codec}
+	if summable, ok := codec.(Summable[T]); ok {
+		e.sum = summable.Int64
+	} else {
+		e.sum = func(T) int64 { return 0 }
+	}
+	return e
+}
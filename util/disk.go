@@ -0,0 +1,851 @@
+package util
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// diskBlockSize is the maximal number of elements in a block of DiskArray, that is the size of a slot in its file
+const diskBlockSize = 1 << 14
+
+const (
+	// indexSuffix is appended to the path of the file to get the path of its index, that lists the blocks of the array
+	indexSuffix = ".index"
+	indexMagic  = "DSKIDX01"
+	// indexHeaderSize is the size of the magic followed by the slot size, the element size, and the numbers of slots
+	// and blocks; every block is then described by its slot, size, hash, sum, minimum and maximum
+	indexHeaderSize = len(indexMagic) + 4*8
+)
+
+type (
+	// diskStore keeps blocks in slots of a file along with an LRU cache of the recently used ones.
+	// Cached blocks are written back once evicted or flushed; the ones that could not be written stay cached.
+	// A slot is freed once the last of the array and its snapshots holding it releases it.
+	// The first error reading the file is kept, see DiskArrayOf.Err.
+	diskStore[T comparable] struct {
+		codec     Codec[T]
+		file      *os.File
+		slotSize  int
+		slots     int
+		free      []int
+		refs      []int
+		cache     map[int]*list.Element
+		lru       *list.List
+		cacheSize int
+		err       error
+		mutex     sync.Mutex
+	}
+
+	cachedBlock[T comparable] struct {
+		slot  int
+		array []T
+		dirty bool
+	}
+
+	diskBlock[T comparable] struct {
+		slot      int
+		size      int
+		hash      uint64
+		aggregate AggregateOf[T]
+	}
+
+	// DiskArrayOf is the sequence for documents that do not fit into memory: it keeps only the positions of its blocks
+	// in memory, and the blocks themselves are stored in a file and cached. Modified blocks are written to the file
+	// once evicted from the cache or on Flush. Snapshots share the file with the array: blocks held by several of them
+	// are copied to new slots before being modified, and the slots are reused once everyone holding them releases them.
+	// Elements are stored with the codec, that must encode all of them with the same number of bytes.
+	// Flush writes the index of the blocks next to the file, so that the array could be opened again.
+	DiskArrayOf[T comparable] struct {
+		elements *elements[T]
+		store    *diskStore[T]
+		blocks   []*diskBlock[T]
+		offsets  Fenwick
+		hashes   hashTree
+		size     int
+		// whether blocks, offsets and hashes themselves are shared with a snapshot
+		shared bool
+		// whether Flush writes the index, that snapshots never do
+		indexed bool
+	}
+
+	DiskArray = DiskArrayOf[int32]
+)
+
+// NewDiskArray creates the array holding a copy of the given one in the new file at the path; the file must not exist,
+// so that an array stored before is never overwritten, see OpenDiskArray. cacheSize is the number of blocks kept
+// in memory.
+func NewDiskArray(path string, array []int32, cacheSize int) (*DiskArray, error) {
+	return NewDiskArrayOf(Int32Codec, path, array, cacheSize)
+}
+
+func NewDiskArrayOf[T comparable](codec Codec[T], path string, array []T, cacheSize int) (*DiskArrayOf[T], error) {
+	return newDiskArray(codec, path, array, diskBlockSize, cacheSize)
+}
+
+// NewDiskArrayFromReader creates the array in the new file at the path like NewDiskArrayOf does, reading its elements
+// encoded by the codec one after another (see util.Encode) from the reader block by block, so that they are never
+// kept in memory all at once
+func NewDiskArrayFromReader[T comparable](codec Codec[T], path string, reader io.Reader, cacheSize int) (*DiskArrayOf[T], error) {
+	da, err := createDiskArray(codec, path, diskBlockSize, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := da.readFrom(reader); err != nil {
+		da.store.file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return da, nil
+}
+
+// OpenDiskArray opens the array stored in the file at the path, see OpenDiskArrayOf
+func OpenDiskArray(path string, cacheSize int) (*DiskArray, error) {
+	return OpenDiskArrayOf(Int32Codec, path, cacheSize)
+}
+
+// OpenDiskArrayOf opens the array stored in the file at the path as of its last Flush, reading only the index of its
+// blocks. The codec must be the one the array was created with. Blocks written back to the file after the last Flush
+// do not match the index, so the array must have been flushed or closed last.
+func OpenDiskArrayOf[T comparable](codec Codec[T], path string, cacheSize int) (*DiskArrayOf[T], error) {
+	index, err := os.ReadFile(path + indexSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not read index of %s: %w", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+	da, err := openDiskArray(codec, file, index, cacheSize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return da, nil
+}
+
+func newDiskArray[T comparable](codec Codec[T], path string, array []T, blockSize, cacheSize int) (*DiskArrayOf[T], error) {
+	da, err := createDiskArray(codec, path, blockSize, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	da.Set(array)
+	return da, nil
+}
+
+// createDiskArray creates the empty array without blocks in the new file at the path
+func createDiskArray[T comparable](codec Codec[T], path string, blockSize, cacheSize int) (*DiskArrayOf[T], error) {
+	if codec.Size() <= 0 {
+		return nil, fmt.Errorf("could not store elements in %s: their encodings differ in length", path)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %w", path, err)
+	}
+	return &DiskArrayOf[T]{elements: newElements(codec), store: newDiskStore(codec, file, blockSize, cacheSize), indexed: true}, nil
+}
+
+// openDiskArray restores the array from the index written by Flush
+func openDiskArray[T comparable](codec Codec[T], file *os.File, index []byte, cacheSize int) (*DiskArrayOf[T], error) {
+	broken := fmt.Errorf("could not open %s: its index is broken", file.Name())
+	if len(index) < indexHeaderSize || string(index[:len(indexMagic)]) != indexMagic {
+		return nil, broken
+	}
+	header := func(i int) int {
+		return int(binary.LittleEndian.Uint64(index[len(indexMagic)+i*8:]))
+	}
+	slotSize, width, slots, count := header(0), header(1), header(2), header(3)
+	if width != codec.Size() {
+		return nil, fmt.Errorf("could not open %s: its elements are encoded with %d bytes, whilst the codec takes %d", file.Name(), width, codec.Size())
+	}
+	record := 4*8 + 2*width
+	if slotSize <= 0 || slots < 0 || count <= 0 || (len(index)-indexHeaderSize)%record != 0 || (len(index)-indexHeaderSize)/record != count {
+		return nil, broken
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", file.Name(), err)
+	}
+	// free slots might have never been written, but the ones of the blocks must be within the file
+	if slots > count+int(info.Size()/int64(slotSize*width)) {
+		return nil, broken
+	}
+	store := newDiskStore(codec, file, slotSize, cacheSize)
+	store.slots, store.refs = slots, make([]int, slots)
+	da := &DiskArrayOf[T]{elements: newElements(codec), store: store, indexed: true}
+	for data := index[indexHeaderSize:]; len(data) > 0; data = data[record:] {
+		b := &diskBlock[T]{slot: int(binary.LittleEndian.Uint64(data)), size: int(binary.LittleEndian.Uint64(data[8:])), hash: binary.LittleEndian.Uint64(data[16:])}
+		if b.slot < 0 || b.slot >= slots || store.refs[b.slot] != 0 || b.size < 0 || b.size > slotSize || store.offset(b.slot)+int64(b.size*width) > info.Size() {
+			return nil, broken
+		}
+		minimum, _, err := codec.Decode(data[32:])
+		if err != nil {
+			return nil, fmt.Errorf("could not open %s: %w", file.Name(), err)
+		}
+		maximum, _, err := codec.Decode(data[32+width:])
+		if err != nil {
+			return nil, fmt.Errorf("could not open %s: %w", file.Name(), err)
+		}
+		b.aggregate = AggregateOf[T]{Count: b.size, Sum: int64(binary.LittleEndian.Uint64(data[24:])), Min: minimum, Max: maximum}
+		store.refs[b.slot] = 1
+		da.blocks = append(da.blocks, b)
+		da.size += b.size
+	}
+	for slot, refs := range store.refs {
+		if refs == 0 {
+			store.free = append(store.free, slot)
+		}
+	}
+	da.rebuildOffsets()
+	return da, nil
+}
+
+func newDiskStore[T comparable](codec Codec[T], file *os.File, slotSize, cacheSize int) *diskStore[T] {
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	return &diskStore[T]{codec: codec, file: file, slotSize: slotSize, cache: make(map[int]*list.Element), lru: list.New(), cacheSize: cacheSize}
+}
+
+func (da *DiskArrayOf[T]) Get(pos int) T {
+	if pos >= da.size {
+		panic(fmt.Errorf("could not get element at position %d: the size is only %d", pos, da.size))
+	}
+	blockIndex, inBlockPos := da.locate(pos)
+	var value T
+	b := da.blocks[blockIndex]
+	da.store.read(b.slot, b.size, func(array []T) {
+		value = array[inBlockPos]
+	})
+	return value
+}
+
+func (da *DiskArrayOf[T]) Insert(pos int, value T) {
+	if pos > da.size {
+		panic(fmt.Errorf("could not insert element at position %d: the size is only %d", pos, da.size))
+	}
+	da.own()
+	blockIndex, inBlockPos := da.locate(pos)
+	if da.blocks[blockIndex].size == da.store.slotSize {
+		da.split(blockIndex)
+		blockIndex, inBlockPos = da.locate(pos)
+	}
+	b := da.ownBlock(blockIndex)
+	da.store.modify(b.slot, b.size, func(array []T) []T {
+		b.hash += (da.elements.mix(value) + da.elements.hash(array[inBlockPos:])*(hashBase-1)) * power(inBlockPos)
+		array = append(array, value)
+		copy(array[inBlockPos+1:], array[inBlockPos:])
+		array[inBlockPos] = value
+		b.aggregate = da.elements.added(b.aggregate, value)
+		return array
+	})
+	b.size++
+	da.size++
+	da.offsets.Add(blockIndex, 1)
+	da.hashes.set(blockIndex, b.hash, b.size)
+}
+
+func (da *DiskArrayOf[T]) Delete(pos int) {
+	if pos >= da.size {
+		panic(fmt.Errorf("could not delete element at position %d: the size is only %d", pos, da.size))
+	}
+	da.own()
+	blockIndex, inBlockPos := da.locate(pos)
+	b := da.ownBlock(blockIndex)
+	da.store.modify(b.slot, b.size, func(array []T) []T {
+		suffix, removed := da.elements.hash(array[inBlockPos+1:]), array[inBlockPos]
+		b.hash += (suffix - suffix*hashBase - da.elements.mix(removed)) * power(inBlockPos)
+		array = append(array[:inBlockPos], array[inBlockPos+1:]...)
+		b.aggregate = da.elements.removed(b.aggregate, removed, array)
+		return array
+	})
+	b.size--
+	da.size--
+	da.offsets.Add(blockIndex, -1)
+	da.hashes.set(blockIndex, b.hash, b.size)
+	if b.size < da.store.slotSize>>2 && len(da.blocks) > 1 {
+		// merging with a neighbour if the result leaves room for insertions
+		if blockIndex == len(da.blocks)-1 {
+			blockIndex--
+		}
+		if b.size == 0 || da.blocks[blockIndex].size+da.blocks[blockIndex+1].size <= da.store.slotSize*3/4 {
+			da.merge(blockIndex)
+		}
+	}
+}
+
+func (da *DiskArrayOf[T]) Update(pos int, value T) {
+	if pos >= da.size {
+		panic(fmt.Errorf("could not update element at position %d: the size is only %d", pos, da.size))
+	}
+	da.own()
+	blockIndex, inBlockPos := da.locate(pos)
+	b := da.ownBlock(blockIndex)
+	da.store.modify(b.slot, b.size, func(array []T) []T {
+		previous := array[inBlockPos]
+		b.hash += (da.elements.mix(value) - da.elements.mix(previous)) * power(inBlockPos)
+		array[inBlockPos] = value
+		b.aggregate = da.elements.updated(b.aggregate, previous, value, array)
+		return array
+	})
+	da.hashes.set(blockIndex, b.hash, b.size)
+}
+
+func (da *DiskArrayOf[T]) Size() int {
+	return da.size
+}
+
+func (da *DiskArrayOf[T]) Set(array []T) {
+	for _, b := range da.blocks {
+		da.release(b)
+	}
+	da.blocks, da.size = nil, len(array)
+	da.replace(0, 0, array)
+}
+
+func (da *DiskArrayOf[T]) GetAll() []T {
+	return da.Range(0, da.size)
+}
+
+func (da *DiskArrayOf[T]) Range(from, to int) []T {
+	if from < 0 || to > da.size || from > to {
+		panic(fmt.Errorf("could not get range [%d, %d): the size is only %d", from, to, da.size))
+	}
+	array := make([]T, 0, to-from)
+	da.Iterate(from, to, func(pos int, value T) bool {
+		array = append(array, value)
+		return true
+	})
+	return array
+}
+
+func (da *DiskArrayOf[T]) InsertRange(pos int, values []T) {
+	if pos > da.size {
+		panic(fmt.Errorf("could not insert elements at position %d: the size is only %d", pos, da.size))
+	}
+	if len(values) == 0 {
+		return
+	}
+	blockIndex, inBlockPos := da.locate(pos)
+	b := da.blocks[blockIndex]
+	array := make([]T, 0, b.size+len(values))
+	da.store.read(b.slot, b.size, func(existing []T) {
+		array = append(append(append(array, existing[:inBlockPos]...), values...), existing[inBlockPos:]...)
+	})
+	da.size += len(values)
+	da.replace(blockIndex, blockIndex+1, array)
+}
+
+func (da *DiskArrayOf[T]) DeleteRange(from, to int) {
+	if from < 0 || to > da.size || from > to {
+		panic(fmt.Errorf("could not delete range [%d, %d): the size is only %d", from, to, da.size))
+	}
+	if from == to {
+		return
+	}
+	fromBlock, fromPos := da.locate(from)
+	toBlock, toPos := da.locate(to - 1)
+	var array []T
+	first, last := da.blocks[fromBlock], da.blocks[toBlock]
+	da.store.read(first.slot, first.size, func(existing []T) {
+		array = append(array, existing[:fromPos]...)
+	})
+	da.store.read(last.slot, last.size, func(existing []T) {
+		array = append(array, existing[toPos+1:]...)
+	})
+	da.size -= to - from
+	da.replace(fromBlock, toBlock+1, array)
+}
+
+func (da *DiskArrayOf[T]) Iterate(from, to int, f func(pos int, value T) bool) {
+	if from >= to {
+		return
+	}
+	blockIndex, inBlockPos := da.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		// copying the block out, so that the function is called without holding the store
+		var values []T
+		b := da.blocks[blockIndex]
+		da.store.read(b.slot, b.size, func(array []T) {
+			end := len(array)
+			if end-inBlockPos > to-pos {
+				end = inBlockPos + to - pos
+			}
+			values = append(values, array[inBlockPos:end]...)
+		})
+		for _, value := range values {
+			if !f(pos, value) {
+				return
+			}
+			pos++
+		}
+	}
+}
+
+// Aggregate summarizes the elements in [from, to) reading only the blocks it covers partially
+func (da *DiskArrayOf[T]) Aggregate(from, to int) AggregateOf[T] {
+	if from < 0 || to > da.size || from > to {
+		panic(fmt.Errorf("could not aggregate range [%d, %d): the size is only %d", from, to, da.size))
+	}
+	var result AggregateOf[T]
+	blockIndex, inBlockPos := da.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		b := da.blocks[blockIndex]
+		if inBlockPos == 0 && pos+b.size <= to {
+			result = da.elements.combine(result, b.aggregate)
+			pos += b.size
+			continue
+		}
+		end := b.size
+		if end-inBlockPos > to-pos {
+			end = inBlockPos + to - pos
+		}
+		da.store.read(b.slot, b.size, func(array []T) {
+			result = da.elements.combine(result, da.elements.aggregateOf(array[inBlockPos:end]))
+		})
+		pos += end - inBlockPos
+	}
+	return result
+}
+
+func (da *DiskArrayOf[T]) Hash() uint64 {
+	return da.hashes.root()
+}
+
+// HashRange combines hashes of the blocks within the range, reading only the blocks it covers partially
+func (da *DiskArrayOf[T]) HashRange(from, to int) uint64 {
+	if from < 0 || to > da.size || from > to {
+		panic(fmt.Errorf("could not hash range [%d, %d): the size is only %d", from, to, da.size))
+	}
+	hash := uint64(0)
+	if from == to {
+		return hash
+	}
+	blockIndex, inBlockPos := da.locate(from)
+	for pos := from; pos < to; blockIndex, inBlockPos = blockIndex+1, 0 {
+		b := da.blocks[blockIndex]
+		if inBlockPos == 0 && pos+b.size <= to {
+			hash += b.hash * power(pos-from)
+			pos += b.size
+			continue
+		}
+		end := b.size
+		if end-inBlockPos > to-pos {
+			end = inBlockPos + to - pos
+		}
+		da.store.read(b.slot, b.size, func(array []T) {
+			hash += da.elements.hash(array[inBlockPos:end]) * power(pos-from)
+		})
+		pos += end - inBlockPos
+	}
+	return hash
+}
+
+// Snapshot returns a copy of the array sharing the file and all the blocks with it. It takes time proportional
+// to the number of blocks, that are counted as held by the snapshot too.
+func (da *DiskArrayOf[T]) Snapshot() SequenceOf[T] {
+	da.store.retain(da.blocks)
+	snapshot := *da
+	snapshot.shared, da.shared = true, true
+	snapshot.indexed = false
+	return &snapshot
+}
+
+// Release frees the slots of the blocks that neither the array it was taken from nor other snapshots hold
+func (da *DiskArrayOf[T]) Release() {
+	for _, b := range da.blocks {
+		da.store.release(b.slot)
+	}
+	da.blocks, da.size = nil, 0
+	da.rebuildOffsets()
+}
+
+func (da *DiskArrayOf[T]) Codec() Codec[T] {
+	return da.elements.codec
+}
+
+// Flush writes all the modified blocks to the file followed by the index of the array, that snapshots do not write
+func (da *DiskArrayOf[T]) Flush() error {
+	if err := da.store.flush(); err != nil {
+		return err
+	}
+	if !da.indexed {
+		return nil
+	}
+	return da.store.writeIndex(da.blocks)
+}
+
+// Err returns the error reading the file has failed with. Elements of the block that could not be read are zero
+// values, so the array is not flushed anymore: Flush and Close fail with the error.
+func (da *DiskArrayOf[T]) Err() error {
+	return da.store.failure()
+}
+
+// Close flushes the array and closes its file, that makes the array and its snapshots unusable. Blocks that could not
+// be written when evicted are written here as well, so their errors are reported by Flush and Close.
+func (da *DiskArrayOf[T]) Close() error {
+	if err := da.Flush(); err != nil {
+		return err
+	}
+	return da.store.file.Close()
+}
+
+// replace puts blocks made of the array in place of the blocks in [from, to). Blocks are filled by three quarters
+// only, so that there is room for insertions.
+func (da *DiskArrayOf[T]) replace(from, to int, array []T) {
+	fill := da.fill()
+	blocks := make([]*diskBlock[T], 0, len(da.blocks)-(to-from)+len(array)/fill+1)
+	blocks = append(blocks, da.blocks[:from]...)
+	for start := 0; start < len(array); {
+		end := start + fill
+		if len(array)-end < da.store.slotSize>>2 {
+			// the remainder is too small for a block of its own
+			end = len(array)
+		}
+		blocks = append(blocks, da.newBlock(append([]T(nil), array[start:end]...)))
+		start = end
+	}
+	for _, b := range da.blocks[from:to] {
+		da.release(b)
+	}
+	da.blocks = append(blocks, da.blocks[to:]...)
+	if len(da.blocks) == 0 {
+		da.blocks = []*diskBlock[T]{da.newBlock(nil)}
+	}
+	da.rebuildOffsets()
+	da.shared = false
+}
+
+// readFrom appends blocks of the elements read from the reader, filling them like replace does
+func (da *DiskArrayOf[T]) readFrom(reader io.Reader) error {
+	width := da.elements.codec.Size()
+	buffer := make([]byte, da.fill()*width)
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		if n%width != 0 {
+			return fmt.Errorf("could not read elements: the input ends in the middle of element #%d", da.size+n/width)
+		}
+		if n > 0 {
+			values, decodeErr := Decode(da.elements.codec, buffer[:n])
+			if decodeErr != nil {
+				return fmt.Errorf("could not read elements after #%d: %w", da.size, decodeErr)
+			}
+			da.blocks = append(da.blocks, da.newBlock(values))
+			da.size += len(values)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read elements: %w", err)
+		}
+	}
+	if len(da.blocks) == 0 {
+		da.blocks = []*diskBlock[T]{da.newBlock(nil)}
+	}
+	da.rebuildOffsets()
+	return nil
+}
+
+// fill returns the number of elements new blocks get: three quarters of a slot leave room for insertions
+func (da *DiskArrayOf[T]) fill() int {
+	if fill := da.store.slotSize * 3 / 4; fill > 0 {
+		return fill
+	}
+	return 1
+}
+
+// split moves the second half of the block to a new one
+func (da *DiskArrayOf[T]) split(blockIndex int) {
+	left := da.ownBlock(blockIndex)
+	half := left.size >> 1
+	var tail []T
+	da.store.modify(left.slot, left.size, func(array []T) []T {
+		tail = append(tail, array[half:]...)
+		left.hash, left.aggregate = da.elements.hash(array[:half]), da.elements.aggregateOf(array[:half])
+		return array[:half]
+	})
+	left.size = half
+	da.blocks = append(da.blocks, nil)
+	copy(da.blocks[blockIndex+2:], da.blocks[blockIndex+1:])
+	da.blocks[blockIndex+1] = da.newBlock(tail)
+	da.rebuildOffsets()
+}
+
+// merge appends the next block to the given one
+func (da *DiskArrayOf[T]) merge(blockIndex int) {
+	right := da.blocks[blockIndex+1]
+	if right.size != 0 {
+		var tail []T
+		da.store.read(right.slot, right.size, func(array []T) {
+			tail = append(tail, array...)
+		})
+		left := da.ownBlock(blockIndex)
+		da.store.modify(left.slot, left.size, func(array []T) []T {
+			return append(array, tail...)
+		})
+		left.hash += right.hash * power(left.size)
+		left.aggregate = da.elements.combine(left.aggregate, right.aggregate)
+		left.size += right.size
+	}
+	da.release(right)
+	copy(da.blocks[blockIndex+1:], da.blocks[blockIndex+2:])
+	da.blocks[len(da.blocks)-1] = nil
+	da.blocks = da.blocks[:len(da.blocks)-1]
+	da.rebuildOffsets()
+}
+
+// rebuildOffsets rebuilds both the offsets and the hashes of the blocks once the blocks themselves have changed
+func (da *DiskArrayOf[T]) rebuildOffsets() {
+	sizes := make([]int, len(da.blocks))
+	for i, b := range da.blocks {
+		sizes[i] = b.size
+	}
+	da.offsets = NewFenwick(sizes)
+	da.hashes = newHashTree(len(da.blocks), func(i int) (uint64, int) {
+		return da.blocks[i].hash, da.blocks[i].size
+	})
+}
+
+// own copies blocks, offsets and hashes shared with a snapshot, so that they could be modified
+func (da *DiskArrayOf[T]) own() {
+	if !da.shared {
+		return
+	}
+	da.blocks = append(make([]*diskBlock[T], 0, len(da.blocks)+1), da.blocks...)
+	da.offsets = append(Fenwick(nil), da.offsets...)
+	da.hashes = append(hashTree(nil), da.hashes...)
+	da.shared = false
+}
+
+// ownBlock returns the block after copying it to a new slot if a snapshot holds it as well
+func (da *DiskArrayOf[T]) ownBlock(blockIndex int) *diskBlock[T] {
+	b := da.blocks[blockIndex]
+	if da.store.shared(b.slot) {
+		var array []T
+		da.store.read(b.slot, b.size, func(existing []T) {
+			array = append(make([]T, 0, da.store.slotSize), existing...)
+		})
+		da.release(b)
+		b = da.newBlock(array)
+		da.blocks[blockIndex] = b
+	}
+	return b
+}
+
+// newBlock stores the array, that is not copied, in a new slot
+func (da *DiskArrayOf[T]) newBlock(array []T) *diskBlock[T] {
+	slot := da.store.allocate()
+	da.store.put(slot, array)
+	return &diskBlock[T]{slot: slot, size: len(array), hash: da.elements.hash(array), aggregate: da.elements.aggregateOf(array)}
+}
+
+func (da *DiskArrayOf[T]) release(b *diskBlock[T]) {
+	da.store.release(b.slot)
+}
+
+func (da *DiskArrayOf[T]) locate(pos int) (int, int) {
+	blockIndex, startingPos := da.offsets.Search(pos)
+	if blockIndex == len(da.blocks) {
+		blockIndex--
+		startingPos -= da.blocks[blockIndex].size
+	}
+	return blockIndex, pos - startingPos
+}
+
+func (s *diskStore[T]) allocate() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.free) != 0 {
+		slot := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		s.refs[slot] = 1
+		return slot
+	}
+	s.slots++
+	s.refs = append(s.refs, 1)
+	return s.slots - 1
+}
+
+// retain counts the slots of the blocks as held by one more array
+func (s *diskStore[T]) retain(blocks []*diskBlock[T]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, b := range blocks {
+		s.refs[b.slot]++
+	}
+}
+
+// shared tells whether more than one array holds the slot
+func (s *diskStore[T]) shared(slot int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.refs[slot] > 1
+}
+
+// release drops the slot along with its cached contents once no array holds it, so that it could be allocated again
+func (s *diskStore[T]) release(slot int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.refs[slot]--; s.refs[slot] > 0 {
+		return
+	}
+	if element, ok := s.cache[slot]; ok {
+		s.lru.Remove(element)
+		delete(s.cache, slot)
+	}
+	s.free = append(s.free, slot)
+}
+
+// put caches the array as the contents of the slot, that get written to the file later
+func (s *diskStore[T]) put(slot int, array []T) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cache[slot] = s.lru.PushFront(&cachedBlock[T]{slot: slot, array: array, dirty: true})
+	s.evict()
+}
+
+// read passes the contents of the slot holding size elements to the function, that must not retain them
+func (s *diskStore[T]) read(slot, size int, f func(array []T)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(s.load(slot, size).array)
+}
+
+// modify replaces the contents of the slot holding size elements with the result of the function
+func (s *diskStore[T]) modify(slot, size int, f func(array []T) []T) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cached := s.load(slot, size)
+	cached.array, cached.dirty = f(cached.array), true
+}
+
+func (s *diskStore[T]) load(slot, size int) *cachedBlock[T] {
+	if element, ok := s.cache[slot]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*cachedBlock[T])
+	}
+	width := s.codec.Size()
+	buffer := make([]byte, size*width)
+	if _, err := s.file.ReadAt(buffer, s.offset(slot)); err != nil {
+		return s.fail(slot, size, err)
+	}
+	array := make([]T, size, s.slotSize)
+	for i := range array {
+		value, _, err := s.codec.Decode(buffer[i*width:])
+		if err != nil {
+			return s.fail(slot, size, err)
+		}
+		array[i] = value
+	}
+	cached := &cachedBlock[T]{slot: slot, array: array}
+	s.cache[slot] = s.lru.PushFront(cached)
+	s.evict()
+	return cached
+}
+
+// fail keeps the first error reading the file and returns zero values in place of the block. They are not cached,
+// so that they are never written over the block.
+func (s *diskStore[T]) fail(slot, size int, err error) *cachedBlock[T] {
+	if s.err == nil {
+		s.err = fmt.Errorf("could not read block from slot %d: %w", slot, err)
+	}
+	return &cachedBlock[T]{slot: slot, array: make([]T, size, s.slotSize)}
+}
+
+func (s *diskStore[T]) failure() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// evict drops the least recently used blocks beyond the cache size, writing the modified ones back. If a block could
+// not be written, it is kept along with the ones after it, so nothing is lost and Flush reports the error.
+func (s *diskStore[T]) evict() {
+	for s.lru.Len() > s.cacheSize {
+		cached := s.lru.Back().Value.(*cachedBlock[T])
+		if err := s.write(cached); err != nil {
+			return
+		}
+		s.lru.Remove(s.lru.Back())
+		delete(s.cache, cached.slot)
+	}
+}
+
+func (s *diskStore[T]) flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	for element := s.lru.Front(); element != nil; element = element.Next() {
+		if err := s.write(element.Value.(*cachedBlock[T])); err != nil {
+			return err
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %w", s.file.Name(), err)
+	}
+	return nil
+}
+
+// writeIndex replaces the index of the file with the one listing the blocks. It is written into a temporary file
+// first, so that a crash never leaves a broken index behind.
+func (s *diskStore[T]) writeIndex(blocks []*diskBlock[T]) error {
+	s.mutex.Lock()
+	buffer := []byte(indexMagic)
+	for _, value := range []int{s.slotSize, s.codec.Size(), s.slots, len(blocks)} {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(value))
+	}
+	s.mutex.Unlock()
+	for _, b := range blocks {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(b.slot))
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(b.size))
+		buffer = binary.LittleEndian.AppendUint64(buffer, b.hash)
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(b.aggregate.Sum))
+		buffer = s.codec.Append(s.codec.Append(buffer, b.aggregate.Min), b.aggregate.Max)
+	}
+	path := s.file.Name() + indexSuffix
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write index of %s: %w", s.file.Name(), err)
+	}
+	_, err = f.Write(buffer)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("could not write index of %s: %w", s.file.Name(), err)
+	}
+	return nil
+}
+
+func (s *diskStore[T]) write(cached *cachedBlock[T]) error {
+	if !cached.dirty {
+		return nil
+	}
+	buffer := make([]byte, 0, len(cached.array)*s.codec.Size())
+	for _, value := range cached.array {
+		buffer = s.codec.Append(buffer, value)
+	}
+	if _, err := s.file.WriteAt(buffer, s.offset(cached.slot)); err != nil {
+		return fmt.Errorf("could not write block to slot %d: %w", cached.slot, err)
+	}
+	cached.dirty = false
+	return nil
+}
+
+func (s *diskStore[T]) offset(slot int) int64 {
+	return int64(slot) * int64(s.slotSize) * int64(s.codec.Size())
+}
@@ -0,0 +1,49 @@
+package util
+
+// Fenwick is a binary indexed tree over block sizes: it keeps prefix sums of them, that is the positions blocks start at,
+// with both changing a size and finding the block containing a position taking O(log n)
+type Fenwick []int
+
+func NewFenwick(sizes []int) Fenwick {
+	tree := make(Fenwick, len(sizes)+1)
+	for i, size := range sizes {
+		tree[i+1] += size
+		if parent := i + 1 + (i+1)&-(i+1); parent < len(tree) {
+			tree[parent] += tree[i+1]
+		}
+	}
+	return tree
+}
+
+// Add changes the size of the block by delta
+func (f Fenwick) Add(blockIndex, delta int) {
+	for i := blockIndex + 1; i < len(f); i += i & -i {
+		f[i] += delta
+	}
+}
+
+// Prefix returns the total size of the blocks before the given one, that is the position it starts at
+func (f Fenwick) Prefix(blockIndex int) int {
+	sum := 0
+	for i := blockIndex; i > 0; i -= i & -i {
+		sum += f[i]
+	}
+	return sum
+}
+
+// Search returns the first block ending after the position along with the position it starts at;
+// the number of blocks is returned for positions beyond the last element
+func (f Fenwick) Search(pos int) (int, int) {
+	index, start := 0, 0
+	step := 1
+	for step<<1 < len(f) {
+		step <<= 1
+	}
+	for ; step > 0; step >>= 1 {
+		if next := index + step; next < len(f) && start+f[next] <= pos {
+			index = next
+			start += f[next]
+		}
+	}
+	return index, start
+}
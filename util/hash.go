@@ -0,0 +1,109 @@
+package util
+
+// Arrays are hashed polynomially: hash = sum(Codec.Hash(array[i]) * hashBase^i) mod 2^64. Such a hash does not depend
+// on how the array is split into blocks, and the hash of a block could be shifted to any position by a multiplication.
+const hashBase uint64 = 0x100000001b3
+
+// hashBaseInverse is the multiplicative inverse of hashBase modulo 2^64
+var hashBaseInverse = inverse(hashBase)
+
+// Hash returns the polynomial hash of the array, the same BlockedArray.Hash returns for it
+func Hash(array []int32) uint64 {
+	return HashOf(Int32Codec, array)
+}
+
+// HashOf returns the polynomial hash of the array with elements hashed by the codec
+func HashOf[T comparable](codec Codec[T], array []T) uint64 {
+	hash, power := uint64(0), uint64(1)
+	for _, value := range array {
+		hash += codec.Hash(value) * power
+		power *= hashBase
+	}
+	return hash
+}
+
+// mix spreads the bits of the value, so that close values do not produce close hashes (splitmix64 finalizer)
+func mix(value uint64) uint64 {
+	x := value + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func power(exponent int) uint64 {
+	result, base := uint64(1), hashBase
+	for e := uint64(exponent); e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	return result
+}
+
+func inverse(odd uint64) uint64 {
+	// Newton's iteration doubles the number of correct low bits every step
+	x := odd
+	for i := 0; i < 5; i++ {
+		x *= 2 - odd*x
+	}
+	return x
+}
+
+func (e *elements[T]) hash(array []T) uint64 {
+	return HashOf(e.codec, array)
+}
+
+func (e *elements[T]) mix(value T) uint64 {
+	return e.codec.Hash(value)
+}
+
+type hashNode struct {
+	hash uint64
+	// power is hashBase to the number of elements hashed, that is how far the hash of the next node is shifted
+	power uint64
+}
+
+// hashTree is a segment tree combining hashes of consecutive blocks into the hash of the whole array, so that a change
+// of a block rehashes O(log n) nodes instead of all the blocks. Leaves start at len(tree) / 2, the ones past
+// the last block are empty.
+type hashTree []hashNode
+
+func newHashTree(count int, block func(i int) (uint64, int)) hashTree {
+	leaves := 1
+	for leaves < count {
+		leaves <<= 1
+	}
+	tree := make(hashTree, leaves<<1)
+	for i := range tree[leaves:] {
+		if i < count {
+			hash, size := block(i)
+			tree[leaves+i] = hashNode{hash: hash, power: power(size)}
+		} else {
+			tree[leaves+i] = hashNode{power: 1}
+		}
+	}
+	for i := leaves - 1; i > 0; i-- {
+		tree.combine(i)
+	}
+	return tree
+}
+
+// set changes the hash and the size of the block
+func (t hashTree) set(blockIndex int, hash uint64, size int) {
+	i := len(t)>>1 + blockIndex
+	t[i] = hashNode{hash: hash, power: power(size)}
+	for i >>= 1; i > 0; i >>= 1 {
+		t.combine(i)
+	}
+}
+
+func (t hashTree) combine(i int) {
+	left, right := t[i<<1], t[i<<1|1]
+	t[i] = hashNode{hash: left.hash + right.hash*left.power, power: left.power * right.power}
+}
+
+// root returns the hash of the whole array
+func (t hashTree) root() uint64 {
+	return t[1].hash
+}
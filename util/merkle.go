@@ -0,0 +1,97 @@
+package util
+
+// MerkleTree hashes a sequence split into leaves of a fixed size, so that two replicas could find the leaves they
+// differ in by comparing hashes from the root down. Level 0 holds the root, the last level holds the leaves.
+// Nodes are not stored: each one is hashed when asked for from the hashes of the blocks the sequence maintains anyway,
+// so neither building the tree nor comparing a few of its nodes copies the elements.
+type MerkleTree struct {
+	leafSize int
+	size     int
+	depth    int
+	hash     func(from, to int) uint64
+}
+
+// NewMerkleTree builds the tree over the first size elements of the sequence; leaves beyond its end are hashed as empty,
+// so a replica of a different length still gets a tree of the same shape. The sequence must not be modified while
+// the tree is in use.
+func NewMerkleTree(sequence Sequence, size, leafSize int) *MerkleTree {
+	return NewMerkleTreeOf[int32](sequence, size, leafSize)
+}
+
+// NewMerkleTreeOf builds the tree over a sequence of elements of type T
+func NewMerkleTreeOf[T comparable](sequence SequenceOf[T], size, leafSize int) *MerkleTree {
+	leaves := (size + leafSize - 1) / leafSize
+	depth := 1
+	for width := 1; width < leaves; width *= 2 {
+		depth++
+	}
+	hash := func(from, to int) uint64 {
+		if to > sequence.Size() {
+			to = sequence.Size()
+		}
+		if from > to {
+			from = to
+		}
+		return combine(sequence.HashRange(from, to), uint64(to-from))
+	}
+	return &MerkleTree{leafSize: leafSize, size: size, depth: depth, hash: hash}
+}
+
+func (t *MerkleTree) Root() uint64 {
+	return t.Node(0, 0)
+}
+
+// Depth returns the number of levels, the root and the leaves included
+func (t *MerkleTree) Depth() int {
+	return t.depth
+}
+
+// Width returns the number of nodes on the level
+func (t *MerkleTree) Width(level int) int {
+	leaves := (t.size + t.leafSize - 1) / t.leafSize
+	span := 1 << (t.depth - 1 - level)
+	if width := (leaves + span - 1) / span; width > 0 {
+		return width
+	}
+	return 1
+}
+
+// Node returns the hash of the range of positions the node covers
+func (t *MerkleTree) Node(level, index int) uint64 {
+	span := t.leafSize << (t.depth - 1 - level)
+	from, to := t.clamp(index*span, (index+1)*span)
+	return t.hash(from, to)
+}
+
+// Children returns indices of the children the node has on the next level
+func (t *MerkleTree) Children(level, index int) []int {
+	if level+1 >= t.depth {
+		return nil
+	}
+	if 2*index+1 < t.Width(level+1) {
+		return []int{2 * index, 2*index + 1}
+	}
+	return []int{2 * index}
+}
+
+// Leaf returns the range of positions [from, to) covered by the leaf
+func (t *MerkleTree) Leaf(index int) (int, int) {
+	return t.clamp(index*t.leafSize, (index+1)*t.leafSize)
+}
+
+func (t *MerkleTree) clamp(from, to int) (int, int) {
+	if to > t.size {
+		to = t.size
+	}
+	if from > to {
+		from = to
+	}
+	return from, to
+}
+
+func combine(left, right uint64) uint64 {
+	x := left*hashBase ^ right
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
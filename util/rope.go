@@ -0,0 +1,429 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// ropeLeafSize is the maximal number of elements kept in a single node
+const ropeLeafSize = 256
+
+type (
+	ropeNode[T comparable] struct {
+		elements       *elements[T]
+		chunk          []T
+		chunkHash      uint64
+		chunkAggregate AggregateOf[T]
+		left, right    *ropeNode[T]
+		priority       uint32
+		generation     uint64
+		// size, hash and aggregate of the whole subtree
+		size      int
+		hash      uint64
+		aggregate AggregateOf[T]
+	}
+
+	// RopeOf keeps chunks of elements in an implicit treap ordered by position: single modifications take O(log n)
+	// and so do cutting and joining, so bulk insertions and deletions do not depend on the size of the document.
+	// The tree is persistent: snapshots share nodes with the rope, and nodes of other generations are copied
+	// before being modified, so a modification copies a single path of the tree at most.
+	RopeOf[T comparable] struct {
+		elements   *elements[T]
+		root       *ropeNode[T]
+		generation uint64
+	}
+
+	Rope = RopeOf[int32]
+)
+
+func NewRope(array []int32) *Rope {
+	return NewRopeOf(Int32Codec, array)
+}
+
+func NewRopeOf[T comparable](codec Codec[T], array []T) *RopeOf[T] {
+	rope := &RopeOf[T]{elements: newElements(codec), generation: newGeneration()}
+	rope.Set(array)
+	return rope
+}
+
+func (r *RopeOf[T]) Get(pos int) T {
+	if pos >= r.Size() {
+		panic(fmt.Errorf("could not get element at position %d: the size is only %d", pos, r.Size()))
+	}
+	n := r.root
+	for {
+		leftSize := n.left.getSize()
+		if pos < leftSize {
+			n = n.left
+		} else if pos -= leftSize; pos < len(n.chunk) {
+			return n.chunk[pos]
+		} else {
+			pos -= len(n.chunk)
+			n = n.right
+		}
+	}
+}
+
+func (r *RopeOf[T]) Insert(pos int, value T) {
+	if pos > r.Size() {
+		panic(fmt.Errorf("could not insert element at position %d: the size is only %d", pos, r.Size()))
+	}
+	if r.root == nil {
+		r.root = newRopeNode(r.elements, r.generation, []T{value})
+		return
+	}
+	r.root = r.root.insert(r.generation, pos, value)
+}
+
+func (r *RopeOf[T]) Delete(pos int) {
+	if pos >= r.Size() {
+		panic(fmt.Errorf("could not delete element at position %d: the size is only %d", pos, r.Size()))
+	}
+	r.root = r.root.delete(r.generation, pos)
+}
+
+func (r *RopeOf[T]) Update(pos int, value T) {
+	if pos >= r.Size() {
+		panic(fmt.Errorf("could not update element at position %d: the size is only %d", pos, r.Size()))
+	}
+	r.root = r.root.update(r.generation, pos, value)
+}
+
+func (r *RopeOf[T]) Size() int {
+	return r.root.getSize()
+}
+
+func (r *RopeOf[T]) Set(array []T) {
+	r.root = buildRope(r.elements, r.generation, array)
+}
+
+func (r *RopeOf[T]) GetAll() []T {
+	return r.Range(0, r.Size())
+}
+
+func (r *RopeOf[T]) Range(from, to int) []T {
+	if from < 0 || to > r.Size() || from > to {
+		panic(fmt.Errorf("could not get range [%d, %d): the size is only %d", from, to, r.Size()))
+	}
+	array := make([]T, 0, to-from)
+	r.root.chunks(0, from, to, func(chunk []T) bool {
+		array = append(array, chunk...)
+		return true
+	})
+	return array
+}
+
+func (r *RopeOf[T]) InsertRange(pos int, values []T) {
+	if pos > r.Size() {
+		panic(fmt.Errorf("could not insert elements at position %d: the size is only %d", pos, r.Size()))
+	}
+	left, right := r.root.split(r.generation, pos)
+	r.root = mergeRopes(r.generation, mergeRopes(r.generation, left, buildRope(r.elements, r.generation, values)), right)
+}
+
+func (r *RopeOf[T]) DeleteRange(from, to int) {
+	if from < 0 || to > r.Size() || from > to {
+		panic(fmt.Errorf("could not delete range [%d, %d): the size is only %d", from, to, r.Size()))
+	}
+	left, rest := r.root.split(r.generation, from)
+	_, right := rest.split(r.generation, to-from)
+	r.root = mergeRopes(r.generation, left, right)
+}
+
+func (r *RopeOf[T]) Iterate(from, to int, f func(pos int, value T) bool) {
+	pos := from
+	r.root.chunks(0, from, to, func(chunk []T) bool {
+		for _, value := range chunk {
+			if !f(pos, value) {
+				return false
+			}
+			pos++
+		}
+		return true
+	})
+}
+
+func (r *RopeOf[T]) Hash() uint64 {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.hash
+}
+
+// Aggregate summarizes the elements in [from, to) combining aggregates of the subtrees within the range
+func (r *RopeOf[T]) Aggregate(from, to int) AggregateOf[T] {
+	if from < 0 || to > r.Size() || from > to {
+		panic(fmt.Errorf("could not aggregate range [%d, %d): the size is only %d", from, to, r.Size()))
+	}
+	return r.root.aggregateRange(0, from, to)
+}
+
+// HashRange combines hashes of the subtrees within the range
+func (r *RopeOf[T]) HashRange(from, to int) uint64 {
+	if from < 0 || to > r.Size() || from > to {
+		panic(fmt.Errorf("could not hash range [%d, %d): the size is only %d", from, to, r.Size()))
+	}
+	return r.root.hashRange(0, from, to)
+}
+
+// Snapshot returns a copy of the rope in O(1) sharing all the nodes with it
+func (r *RopeOf[T]) Snapshot() SequenceOf[T] {
+	r.generation = newGeneration()
+	return &RopeOf[T]{elements: r.elements, root: r.root, generation: newGeneration()}
+}
+
+// Release does nothing: nodes shared with snapshots are garbage collected
+func (r *RopeOf[T]) Release() {
+}
+
+func (r *RopeOf[T]) Codec() Codec[T] {
+	return r.elements.codec
+}
+
+func newRopeNode[T comparable](e *elements[T], generation uint64, chunk []T) *ropeNode[T] {
+	n := &ropeNode[T]{elements: e, chunk: chunk, chunkHash: e.hash(chunk), chunkAggregate: e.aggregateOf(chunk), priority: rand.Uint32(), generation: generation}
+	n.recalculate()
+	return n
+}
+
+// buildRope splits the array into full chunks and joins them
+func buildRope[T comparable](e *elements[T], generation uint64, array []T) *ropeNode[T] {
+	var root *ropeNode[T]
+	for from := 0; from < len(array); from += ropeLeafSize {
+		to := from + ropeLeafSize
+		if to > len(array) {
+			to = len(array)
+		}
+		chunk := make([]T, to-from, ropeLeafSize)
+		copy(chunk, array[from:to])
+		root = mergeRopes(generation, root, newRopeNode(e, generation, chunk))
+	}
+	return root
+}
+
+// mergeRopes joins two trees, so that all the elements of the left one precede the elements of the right one
+func mergeRopes[T comparable](generation uint64, left, right *ropeNode[T]) *ropeNode[T] {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.priority > right.priority {
+		left = left.own(generation)
+		left.right = mergeRopes(generation, left.right, right)
+		left.recalculate()
+		return left
+	}
+	right = right.own(generation)
+	right.left = mergeRopes(generation, left, right.left)
+	right.recalculate()
+	return right
+}
+
+// split cuts the tree into the one with the first pos elements and the one with the rest of them
+func (n *ropeNode[T]) split(generation uint64, pos int) (*ropeNode[T], *ropeNode[T]) {
+	if n == nil {
+		return nil, nil
+	}
+	n = n.own(generation)
+	leftSize := n.left.getSize()
+	if pos <= leftSize {
+		left, right := n.left.split(generation, pos)
+		n.left = right
+		n.recalculate()
+		return left, n
+	}
+	if pos >= leftSize+len(n.chunk) {
+		left, right := n.right.split(generation, pos-leftSize-len(n.chunk))
+		n.right = left
+		n.recalculate()
+		return n, right
+	}
+	// the chunk itself is cut
+	pos -= leftSize
+	tail := make([]T, len(n.chunk)-pos, ropeLeafSize)
+	copy(tail, n.chunk[pos:])
+	n.chunk = n.chunk[:pos]
+	n.chunkHash, n.chunkAggregate = n.elements.hash(n.chunk), n.elements.aggregateOf(n.chunk)
+	right := mergeRopes(generation, newRopeNode(n.elements, generation, tail), n.right)
+	n.right = nil
+	n.recalculate()
+	return n, right
+}
+
+// insert returns the node itself or its copy if the node belongs to another generation; so do delete and update
+func (n *ropeNode[T]) insert(generation uint64, pos int, value T) *ropeNode[T] {
+	n = n.own(generation)
+	leftSize := n.left.getSize()
+	if pos < leftSize {
+		n.left = n.left.insert(generation, pos, value)
+	} else if pos -= leftSize; pos <= len(n.chunk) {
+		if len(n.chunk) == ropeLeafSize {
+			// the chunk is full: moving its second half to a new node
+			half := len(n.chunk) >> 1
+			tail := make([]T, len(n.chunk)-half, ropeLeafSize)
+			copy(tail, n.chunk[half:])
+			n.chunk = n.chunk[:half]
+			n.chunkHash, n.chunkAggregate = n.elements.hash(n.chunk), n.elements.aggregateOf(n.chunk)
+			n.right = mergeRopes(generation, newRopeNode(n.elements, generation, tail), n.right)
+			n.recalculate()
+			return n.insert(generation, pos+leftSize, value)
+		}
+		n.chunkHash += (n.elements.mix(value) + n.elements.hash(n.chunk[pos:])*(hashBase-1)) * power(pos)
+		n.chunk = append(n.chunk, value)
+		copy(n.chunk[pos+1:], n.chunk[pos:])
+		n.chunk[pos] = value
+		n.chunkAggregate = n.elements.added(n.chunkAggregate, value)
+	} else {
+		n.right = n.right.insert(generation, pos-len(n.chunk), value)
+	}
+	n.recalculate()
+	return n
+}
+
+// delete returns the subtree that replaces the node, as the node disappears once its chunk is empty
+func (n *ropeNode[T]) delete(generation uint64, pos int) *ropeNode[T] {
+	leftSize := n.left.getSize()
+	if pos >= leftSize && pos-leftSize < len(n.chunk) && len(n.chunk) == 1 {
+		return mergeRopes(generation, n.left, n.right)
+	}
+	n = n.own(generation)
+	if pos < leftSize {
+		n.left = n.left.delete(generation, pos)
+	} else if pos -= leftSize; pos < len(n.chunk) {
+		suffix, removed := n.elements.hash(n.chunk[pos+1:]), n.chunk[pos]
+		n.chunkHash += (suffix - suffix*hashBase - n.elements.mix(removed)) * power(pos)
+		n.chunk = append(n.chunk[:pos], n.chunk[pos+1:]...)
+		n.chunkAggregate = n.elements.removed(n.chunkAggregate, removed, n.chunk)
+	} else {
+		n.right = n.right.delete(generation, pos-len(n.chunk))
+	}
+	n.recalculate()
+	return n
+}
+
+func (n *ropeNode[T]) update(generation uint64, pos int, value T) *ropeNode[T] {
+	n = n.own(generation)
+	leftSize := n.left.getSize()
+	if pos < leftSize {
+		n.left = n.left.update(generation, pos, value)
+	} else if pos -= leftSize; pos < len(n.chunk) {
+		previous := n.chunk[pos]
+		n.chunkHash += (n.elements.mix(value) - n.elements.mix(previous)) * power(pos)
+		n.chunk[pos] = value
+		n.chunkAggregate = n.elements.updated(n.chunkAggregate, previous, value, n.chunk)
+	} else {
+		n.right = n.right.update(generation, pos-len(n.chunk), value)
+	}
+	n.recalculate()
+	return n
+}
+
+// own returns the node if it belongs to the generation and its copy otherwise
+func (n *ropeNode[T]) own(generation uint64) *ropeNode[T] {
+	if n.generation == generation {
+		return n
+	}
+	copied := *n
+	copied.chunk = append(make([]T, 0, ropeLeafSize), n.chunk...)
+	copied.generation = generation
+	return &copied
+}
+
+// chunks passes the parts of chunks within [from, to) to the function in order, until it returns false;
+// offset is the position the subtree starts at
+func (n *ropeNode[T]) chunks(offset, from, to int, f func(chunk []T) bool) bool {
+	if n == nil || from >= offset+n.size || to <= offset {
+		return true
+	}
+	if !n.left.chunks(offset, from, to, f) {
+		return false
+	}
+	offset += n.left.getSize()
+	start, end := from-offset, to-offset
+	if start < 0 {
+		start = 0
+	}
+	if end > len(n.chunk) {
+		end = len(n.chunk)
+	}
+	if start < end && !f(n.chunk[start:end]) {
+		return false
+	}
+	return n.right.chunks(offset+len(n.chunk), from, to, f)
+}
+
+func (n *ropeNode[T]) recalculate() {
+	leftSize := n.left.getSize()
+	n.size = leftSize + len(n.chunk) + n.right.getSize()
+	n.hash = n.left.getHash() + n.chunkHash*power(leftSize)
+	n.aggregate = n.chunkAggregate
+	if n.left != nil {
+		n.aggregate = n.elements.combine(n.left.aggregate, n.aggregate)
+	}
+	if n.right != nil {
+		n.hash += n.right.hash * power(leftSize+len(n.chunk))
+		n.aggregate = n.elements.combine(n.aggregate, n.right.aggregate)
+	}
+}
+
+// aggregateRange summarizes the elements within [from, to); offset is the position the subtree starts at
+func (n *ropeNode[T]) aggregateRange(offset, from, to int) AggregateOf[T] {
+	if n == nil || from >= offset+n.size || to <= offset {
+		return AggregateOf[T]{}
+	}
+	if from <= offset && offset+n.size <= to {
+		return n.aggregate
+	}
+	result := n.left.aggregateRange(offset, from, to)
+	offset += n.left.getSize()
+	start, end := from-offset, to-offset
+	if start < 0 {
+		start = 0
+	}
+	if end > len(n.chunk) {
+		end = len(n.chunk)
+	}
+	if start < end {
+		result = n.elements.combine(result, n.elements.aggregateOf(n.chunk[start:end]))
+	}
+	return n.elements.combine(result, n.right.aggregateRange(offset+len(n.chunk), from, to))
+}
+
+// hashRange hashes the elements within [from, to) relative to from; offset is the position the subtree starts at
+func (n *ropeNode[T]) hashRange(offset, from, to int) uint64 {
+	if n == nil || from >= offset+n.size || to <= offset {
+		return 0
+	}
+	if from <= offset && offset+n.size <= to {
+		return n.hash * power(offset-from)
+	}
+	hash := n.left.hashRange(offset, from, to)
+	offset += n.left.getSize()
+	start, end := from-offset, to-offset
+	if start < 0 {
+		start = 0
+	}
+	if end > len(n.chunk) {
+		end = len(n.chunk)
+	}
+	if start < end {
+		hash += n.elements.hash(n.chunk[start:end]) * power(offset+start-from)
+	}
+	return hash + n.right.hashRange(offset+len(n.chunk), from, to)
+}
+
+func (n *ropeNode[T]) getSize() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *ropeNode[T]) getHash() uint64 {
+	if n == nil {
+		return 0
+	}
+	return n.hash
+}
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// SequenceOf is the storage of a document. Positions passed to it are expected to be valid: the callers check bounds
+// themselves, so implementations are free to panic otherwise.
+type SequenceOf[T comparable] interface {
+	Get(pos int) T
+	Insert(pos int, value T)
+	Delete(pos int)
+	Update(pos int, value T)
+	Size() int
+
+	// Set replaces all the elements with a copy of the array
+	Set(array []T)
+	GetAll() []T
+	// Range returns a copy of the elements in [from, to)
+	Range(from, to int) []T
+	// InsertRange inserts all the values, so that the first one ends up at the position
+	InsertRange(pos int, values []T)
+	// DeleteRange removes the elements in [from, to)
+	DeleteRange(from, to int)
+	// Iterate calls the function for the elements in [from, to) in order, until it returns false
+	Iterate(from, to int, f func(pos int, value T) bool)
+
+	// Aggregate summarizes the elements in [from, to)
+	Aggregate(from, to int) AggregateOf[T]
+
+	// Hash returns the polynomial hash of the elements, see util.HashOf
+	Hash() uint64
+	// HashRange returns the polynomial hash of the elements in [from, to) as if they started at position 0
+	HashRange(from, to int) uint64
+
+	// Codec returns the codec the elements are hashed and stored with
+	Codec() Codec[T]
+
+	// Snapshot returns a copy of the sequence sharing the storage with it, so that it is taken without copying the
+	// elements. Both of them stay modifiable and copy the shared parts before modifying them, so a snapshot could be
+	// read while the sequence is modified. Taking a snapshot is a modification of the sequence itself though.
+	Snapshot() SequenceOf[T]
+	// Release lets the storage of a snapshot go once it is not needed, after that the snapshot must not be used.
+	// Sequences in memory leave it to the garbage collector, the ones on disk reuse the space it held.
+	Release()
+}
+
+// PersistentOf is a sequence that keeps its elements outside of memory
+type PersistentOf[T comparable] interface {
+	SequenceOf[T]
+	// Flush writes all the modifications to the storage
+	Flush() error
+	Close() error
+	// Err returns the error reading the storage has failed with, if any: the elements that could not be read
+	// are returned as zero values instead
+	Err() error
+}
+
+// Err returns the error the storage of the sequence has failed with, see PersistentOf.Err; sequences kept in memory
+// never fail
+func Err[T comparable](sequence SequenceOf[T]) error {
+	if persistent, ok := sequence.(PersistentOf[T]); ok {
+		return persistent.Err()
+	}
+	return nil
+}
+
+type (
+	Sequence   = SequenceOf[int32]
+	Persistent = PersistentOf[int32]
+)
+
+// lastGeneration identifies the latest owner of storage, that sequences share with their snapshots
+var lastGeneration uint64
+
+func newGeneration() uint64 {
+	return atomic.AddUint64(&lastGeneration, 1)
+}
+
+// Backend selects the implementation of Sequence for a document
+type Backend int
+
+const (
+	// BackendBlocked is BlockedArray, that suits documents of any size
+	BackendBlocked Backend = iota
+	// BackendRope is Rope, that is better at large bulk insertions and deletions
+	BackendRope
+	// BackendSlice is Slice, that is the cheapest one for small documents
+	BackendSlice
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendBlocked:
+		return "blocked"
+	case BackendRope:
+		return "rope"
+	case BackendSlice:
+		return "slice"
+	default:
+		return fmt.Sprintf("Backend(%d)", int(b))
+	}
+}
+
+// NewSequence creates a sequence of the backend holding a copy of the array
+func NewSequence(backend Backend, array []int32) Sequence {
+	return NewSequenceOf(Int32Codec, backend, array)
+}
+
+// NewSequenceOf creates a sequence of the backend holding a copy of the array of elements handled by the codec
+func NewSequenceOf[T comparable](codec Codec[T], backend Backend, array []T) SequenceOf[T] {
+	switch backend {
+	case BackendRope:
+		return NewRopeOf(codec, array)
+	case BackendSlice:
+		return NewSliceOf(codec, array)
+	default:
+		return NewBlockedArrayOf(codec, array)
+	}
+}
@@ -0,0 +1,465 @@
+package util
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSequenceConformance runs the same random modifications against every backend and a plain slice
+func TestSequenceConformance(t *testing.T) {
+	for _, backend := range []Backend{BackendBlocked, BackendRope, BackendSlice} {
+		backend := backend
+		t.Run(backend.String(), func(t *testing.T) {
+			testSequence(t, func(array []int32) Sequence {
+				return NewSequence(backend, array)
+			})
+		})
+	}
+	t.Run("disk", func(t *testing.T) {
+		testSequence(t, func(array []int32) Sequence {
+			// small blocks and cache, so that blocks are evicted and read back all the time
+			da, err := newDiskArray(Int32Codec, filepath.Join(t.TempDir(), "array"), array, 64, 8)
+			if err != nil {
+				t.Fatalf("could not create disk array: %v", err)
+			}
+			t.Cleanup(func() {
+				if err := da.Close(); err != nil {
+					t.Errorf("could not close disk array: %v", err)
+				}
+			})
+			return da
+		})
+	})
+}
+
+func testSequence(t *testing.T, newSequence func(array []int32) Sequence) {
+	random := rand.New(rand.NewSource(42))
+	expected := make([]int32, 1000)
+	for i := range expected {
+		expected[i] = int32(i)
+	}
+	sequence := newSequence(expected)
+	check := func(action string) {
+		if sequence.Size() != len(expected) {
+			t.Fatalf("size mismatch after %s: expected %d, got %d", action, len(expected), sequence.Size())
+		}
+		actual := sequence.GetAll()
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Fatalf("element %d differs after %s: expected %d, got %d", i, action, expected[i], actual[i])
+			}
+		}
+		if Hash(expected) != sequence.Hash() {
+			t.Fatalf("hash mismatch after %s", action)
+		}
+		if from, to := len(expected)/3, 2*len(expected)/3; Hash(expected[from:to]) != sequence.HashRange(from, to) {
+			t.Fatalf("hash of range [%d, %d) mismatch after %s", from, to, action)
+		}
+		if aggregate, expectedAggregate := sequence.Aggregate(0, len(expected)), newElements(Int32Codec).aggregateOf(expected); aggregate != expectedAggregate {
+			t.Fatalf("aggregate mismatch after %s: %+v instead of %+v", action, aggregate, expectedAggregate)
+		}
+	}
+	check("creation")
+
+	var snapshot Sequence
+	var snapshotted []int32
+	for i := 0; i < 3000; i++ {
+		if i%500 == 0 {
+			if snapshot != nil {
+				checkSnapshot(t, snapshot, snapshotted)
+				snapshot.Release()
+			}
+			snapshot, snapshotted = sequence.Snapshot(), append([]int32(nil), expected...)
+		}
+		switch action := random.Intn(10); {
+		case action < 3:
+			pos, value := random.Intn(len(expected)+1), random.Int31()
+			sequence.Insert(pos, value)
+			expected = append(expected, 0)
+			copy(expected[pos+1:], expected[pos:])
+			expected[pos] = value
+		case action < 5 && len(expected) > 0:
+			pos := random.Intn(len(expected))
+			sequence.Delete(pos)
+			expected = append(expected[:pos], expected[pos+1:]...)
+		case action < 7 && len(expected) > 0:
+			pos, value := random.Intn(len(expected)), random.Int31()
+			sequence.Update(pos, value)
+			expected[pos] = value
+		case action < 8:
+			pos, values := random.Intn(len(expected)+1), make([]int32, random.Intn(600))
+			for j := range values {
+				values[j] = random.Int31()
+			}
+			sequence.InsertRange(pos, values)
+			expected = append(expected[:pos], append(values, expected[pos:]...)...)
+		case action < 9:
+			from := random.Intn(len(expected) + 1)
+			to := from + random.Intn(len(expected)-from+1)/2
+			sequence.DeleteRange(from, to)
+			expected = append(expected[:from], expected[to:]...)
+		default:
+			from := random.Intn(len(expected) + 1)
+			to := from + random.Intn(len(expected)-from+1)
+			actual := sequence.Range(from, to)
+			if len(actual) != to-from {
+				t.Fatalf("range [%d, %d) has %d elements", from, to, len(actual))
+			}
+			for j, value := range actual {
+				if value != expected[from+j] {
+					t.Fatalf("range [%d, %d) differs at %d", from, to, from+j)
+				}
+				if sequence.Get(from+j) != value {
+					t.Fatalf("get differs from range at %d", from+j)
+				}
+			}
+			if aggregate, expectedAggregate := sequence.Aggregate(from, to), newElements(Int32Codec).aggregateOf(expected[from:to]); aggregate != expectedAggregate {
+				t.Fatalf("aggregate of [%d, %d) is %+v instead of %+v", from, to, aggregate, expectedAggregate)
+			}
+			next := from
+			sequence.Iterate(from, to, func(pos int, value int32) bool {
+				if pos != next || value != expected[pos] {
+					t.Fatalf("iteration over [%d, %d) gave %d at %d", from, to, value, pos)
+				}
+				next++
+				return next-from < 10
+			})
+			if limit := from + 10; next != to && next != limit {
+				t.Fatalf("iteration over [%d, %d) stopped at %d", from, to, next)
+			}
+		}
+		check("modification")
+	}
+
+	checkSnapshot(t, snapshot, snapshotted)
+	// modifying the snapshot does not affect the sequence either
+	snapshot.DeleteRange(0, snapshot.Size()/2)
+	snapshot.Insert(0, -1)
+	snapshot.Update(snapshot.Size()-1, -2)
+	check("modification of the snapshot")
+
+	sequence.DeleteRange(0, sequence.Size())
+	expected = expected[:0]
+	check("clearing")
+	sequence.Insert(0, 7)
+	expected = append(expected, 7)
+	check("insertion into empty")
+	sequence.Set([]int32{1, 2, 3})
+	expected = []int32{1, 2, 3}
+	check("set")
+}
+
+func checkSnapshot(t *testing.T, snapshot Sequence, expected []int32) {
+	actual := snapshot.GetAll()
+	if len(actual) != len(expected) {
+		t.Fatalf("snapshot has %d elements instead of %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("snapshot changed at %d: expected %d, got %d", i, expected[i], actual[i])
+		}
+	}
+	if Hash(expected) != snapshot.Hash() {
+		t.Fatalf("snapshot hash changed")
+	}
+}
+
+func TestDiskArrayFlush(t *testing.T) {
+	array := make([]int32, 1000)
+	for i := range array {
+		array[i] = int32(i)
+	}
+	da, err := newDiskArray(Int32Codec, filepath.Join(t.TempDir(), "array"), array, 64, 1000)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	defer da.Close()
+	for i := 0; i < 100; i++ {
+		da.Update(i*7, -int32(i))
+		da.Insert(i*5, int32(i))
+		da.Delete(i * 3)
+	}
+	if err := da.Flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	// reading the blocks through an empty cache
+	reread := *da
+	reread.store = &diskStore[int32]{codec: Int32Codec, file: da.store.file, slotSize: da.store.slotSize, cache: make(map[int]*list.Element), lru: list.New(), cacheSize: 1}
+	expected, actual := da.GetAll(), reread.GetAll()
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Fatalf("element %d was not written: expected %d, found %d", i, expected[i], actual[i])
+		}
+	}
+}
+
+func TestDiskArraySnapshotRelease(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	array := make([]int32, 1000)
+	path := filepath.Join(t.TempDir(), "array")
+	da, err := newDiskArray(Int32Codec, path, array, 64, 8)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	defer da.Close()
+	blocks := len(da.blocks)
+	for i := 0; i < 100; i++ {
+		snapshot := da.Snapshot()
+		for j := 0; j < 50; j++ {
+			da.Update(random.Intn(da.Size()), int32(i))
+		}
+		// a modified snapshot copies blocks too
+		snapshot.Update(0, -1)
+		snapshot.Release()
+	}
+	if err := da.Flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat the file: %v", err)
+	}
+	// the array and a snapshot hold at most two copies of every block at once
+	if limit := int64(2*blocks+1) * 64 * 4; info.Size() > limit {
+		t.Errorf("file has grown to %d bytes, whilst %d blocks take %d at most", info.Size(), blocks, limit)
+	}
+}
+
+func TestDiskArrayReopen(t *testing.T) {
+	random := rand.New(rand.NewSource(7))
+	array := make([]int32, 1000)
+	for i := range array {
+		array[i] = random.Int31()
+	}
+	path := filepath.Join(t.TempDir(), "array")
+	da, err := newDiskArray(Int32Codec, path, array, 64, 4)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	if _, err := newDiskArray(Int32Codec, path, array, 64, 4); err == nil {
+		t.Errorf("existing array was overwritten")
+	}
+	for round := 0; round < 3; round++ {
+		snapshot := da.Snapshot()
+		for i := 0; i < 200; i++ {
+			da.Update(random.Intn(da.Size()), random.Int31())
+			da.Insert(random.Intn(da.Size()+1), random.Int31())
+			da.Delete(random.Intn(da.Size()))
+		}
+		da.InsertRange(random.Intn(da.Size()+1), array[:100])
+		if err := snapshot.(*DiskArray).Flush(); err != nil {
+			t.Fatalf("could not flush snapshot: %v", err)
+		}
+		snapshot.Release()
+		expected, hash, aggregate := da.GetAll(), da.Hash(), da.Aggregate(0, da.Size())
+		if err := da.Close(); err != nil {
+			t.Fatalf("could not close: %v", err)
+		}
+		if da, err = OpenDiskArray(path, 4); err != nil {
+			t.Fatalf("could not reopen disk array: %v", err)
+		}
+		if actual := da.GetAll(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Fatalf("reopened array differs in round %d", round)
+		}
+		if da.Hash() != hash || da.Aggregate(0, da.Size()) != aggregate {
+			t.Fatalf("reopened array has a different hash or aggregate in round %d", round)
+		}
+	}
+	if err := da.Close(); err != nil {
+		t.Errorf("could not close: %v", err)
+	}
+	if _, err := OpenDiskArrayOf(Int64Codec, path, 4); err == nil {
+		t.Errorf("array of int32 was opened as the one of int64")
+	}
+}
+
+func TestDiskArrayFromReader(t *testing.T) {
+	array := make([]int32, 3*diskBlockSize+5)
+	for i := range array {
+		array[i] = int32(i)
+	}
+	da, err := NewDiskArrayFromReader(Int32Codec, filepath.Join(t.TempDir(), "array"), bytes.NewReader(Encode(Int32Codec, array)), 1)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	defer da.Close()
+	if da.Size() != len(array) || da.Hash() != Hash(array) || da.Get(len(array)-1) != array[len(array)-1] {
+		t.Errorf("array read from the reader differs")
+	}
+	path := filepath.Join(t.TempDir(), "broken")
+	if _, err := NewDiskArrayFromReader(Int32Codec, path, bytes.NewReader(make([]byte, 6)), 1); err == nil {
+		t.Errorf("array was read from the input ending in the middle of an element")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file of the array that could not be read was left behind: %v", err)
+	}
+}
+
+func TestDiskArrayReadErrors(t *testing.T) {
+	array := make([]int32, 1000)
+	for i := range array {
+		array[i] = int32(i + 1)
+	}
+	path := filepath.Join(t.TempDir(), "array")
+	da, err := newDiskArray(Int32Codec, path, array, 64, 2)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	defer da.store.file.Close()
+	if err := da.Flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("could not truncate the file: %v", err)
+	}
+	if value := da.Get(500); value != 0 || da.Err() == nil {
+		t.Errorf("block could not be read, but got %d and no error", value)
+	}
+	if err := da.Flush(); err == nil {
+		t.Errorf("array was flushed after the read error")
+	}
+}
+
+func TestDiskArrayWriteErrors(t *testing.T) {
+	array := make([]int32, 1000)
+	path := filepath.Join(t.TempDir(), "array")
+	da, err := newDiskArray(Int32Codec, path, array, 64, 2)
+	if err != nil {
+		t.Fatalf("could not create disk array: %v", err)
+	}
+	defer da.Close()
+	if err := da.Flush(); err != nil {
+		t.Fatalf("could not flush: %v", err)
+	}
+	// blocks could still be read, but not written
+	writable := da.store.file
+	if da.store.file, err = os.Open(path); err != nil {
+		t.Fatalf("could not reopen the file: %v", err)
+	}
+	for i := 0; i < len(array); i += 10 {
+		da.Update(i, int32(i))
+	}
+	if err := da.Flush(); err == nil {
+		t.Errorf("flush succeeded despite the write errors")
+	}
+	da.store.file.Close()
+	da.store.file = writable
+	if err := da.Flush(); err != nil {
+		t.Fatalf("could not flush once the file is writable: %v", err)
+	}
+	reread := *da
+	reread.store = &diskStore[int32]{codec: Int32Codec, file: writable, slotSize: da.store.slotSize, cache: make(map[int]*list.Element), lru: list.New(), cacheSize: 1}
+	for i, value := range reread.GetAll() {
+		expected := int32(0)
+		if i%10 == 0 {
+			expected = int32(i)
+		}
+		if value != expected {
+			t.Fatalf("element %d was not written: expected %d, found %d", i, expected, value)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	words := []string{"", "a", "b", "ab", "ба", "long word"}
+	if decoded, err := Decode(StringCodec, Encode(StringCodec, words)); err != nil || len(decoded) != len(words) {
+		t.Fatalf("could not decode strings: %v, %v", decoded, err)
+	} else {
+		for i := range words {
+			if decoded[i] != words[i] {
+				t.Fatalf("string %d decoded as %q instead of %q", i, decoded[i], words[i])
+			}
+		}
+	}
+	encoded := Encode(StringCodec, words)
+	if _, err := Decode(StringCodec, encoded[:len(encoded)-1]); err == nil {
+		t.Errorf("truncated strings were decoded")
+	}
+	if decoded, err := Decode(Float64Codec, Encode(Float64Codec, []float64{-1.5, 0, 2.25})); err != nil || decoded[0] != -1.5 || decoded[2] != 2.25 {
+		t.Errorf("could not decode floats: %v, %v", decoded, err)
+	}
+	if HashOf(StringCodec, []string{"a", "b"}) == HashOf(StringCodec, []string{"b", "a"}) {
+		t.Errorf("hash does not depend on the order of strings")
+	}
+	if _, err := NewDiskArrayOf(StringCodec, filepath.Join(t.TempDir(), "strings"), words, 1); err == nil {
+		t.Errorf("strings of different lengths were stored on disk")
+	}
+}
+
+// TestGenericSequences checks that sequences of strings and int64 behave like plain slices on every backend
+func TestGenericSequences(t *testing.T) {
+	for _, backend := range []Backend{BackendBlocked, BackendRope, BackendSlice} {
+		backend := backend
+		t.Run(backend.String(), func(t *testing.T) {
+			testGenericSequence(t, StringCodec, func(array []string) SequenceOf[string] {
+				return NewSequenceOf(StringCodec, backend, array)
+			}, func(i int) string {
+				return string(rune('a' + i%26))
+			})
+			testGenericSequence(t, Int64Codec, func(array []int64) SequenceOf[int64] {
+				return NewSequenceOf(Int64Codec, backend, array)
+			}, func(i int) int64 {
+				return int64(i) << 40
+			})
+		})
+	}
+	t.Run("disk", func(t *testing.T) {
+		testGenericSequence(t, Int64Codec, func(array []int64) SequenceOf[int64] {
+			da, err := newDiskArray(Int64Codec, filepath.Join(t.TempDir(), "array"), array, 64, 8)
+			if err != nil {
+				t.Fatalf("could not create disk array: %v", err)
+			}
+			t.Cleanup(func() {
+				da.Close()
+			})
+			return da
+		}, func(i int) int64 {
+			return -int64(i) << 40
+		})
+	})
+}
+
+func testGenericSequence[T comparable](t *testing.T, codec Codec[T], newSequence func(array []T) SequenceOf[T], value func(i int) T) {
+	random := rand.New(rand.NewSource(42))
+	e := newElements(codec)
+	expected := make([]T, 500)
+	for i := range expected {
+		expected[i] = value(i)
+	}
+	sequence := newSequence(expected)
+	for i := 0; i < 2000; i++ {
+		pos := random.Intn(len(expected) + 1)
+		switch {
+		case random.Intn(3) == 0 && pos < len(expected):
+			sequence.Delete(pos)
+			expected = append(expected[:pos], expected[pos+1:]...)
+		case random.Intn(2) == 0 && pos < len(expected):
+			sequence.Update(pos, value(i))
+			expected[pos] = value(i)
+		default:
+			sequence.Insert(pos, value(i))
+			expected = append(expected[:pos], append([]T{value(i)}, expected[pos:]...)...)
+		}
+	}
+	actual := sequence.GetAll()
+	if len(actual) != len(expected) {
+		t.Fatalf("sequence has %d elements instead of %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("element %d differs: expected %v, got %v", i, expected[i], actual[i])
+		}
+	}
+	if HashOf(codec, expected) != sequence.Hash() {
+		t.Fatalf("hash mismatch")
+	}
+	if aggregate, expectedAggregate := sequence.Aggregate(10, 300), e.aggregateOf(expected[10:300]); aggregate != expectedAggregate {
+		t.Fatalf("aggregate mismatch: %+v instead of %+v", aggregate, expectedAggregate)
+	}
+}
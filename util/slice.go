@@ -0,0 +1,199 @@
+package util
+
+import "fmt"
+
+type (
+	// SliceOf keeps elements in a single slice: modifications are linear, but there is no overhead for small
+	// documents. The slice is shared with snapshots until either of them modifies it, copying it first.
+	// Aggregates are kept in a segment tree, that is rebuilt on the first query after an insertion or a deletion.
+	SliceOf[T comparable] struct {
+		elements   *elements[T]
+		array      []T
+		aggregates []AggregateOf[T]
+		hash       uint64
+		shared     bool
+	}
+
+	Slice = SliceOf[int32]
+)
+
+func NewSlice(array []int32) *Slice {
+	return NewSliceOf(Int32Codec, array)
+}
+
+func NewSliceOf[T comparable](codec Codec[T], array []T) *SliceOf[T] {
+	slice := &SliceOf[T]{elements: newElements(codec)}
+	slice.Set(array)
+	return slice
+}
+
+func (s *SliceOf[T]) Get(pos int) T {
+	if pos >= len(s.array) {
+		panic(fmt.Errorf("could not get element at position %d: the size is only %d", pos, len(s.array)))
+	}
+	return s.array[pos]
+}
+
+func (s *SliceOf[T]) Insert(pos int, value T) {
+	if pos > len(s.array) {
+		panic(fmt.Errorf("could not insert element at position %d: the size is only %d", pos, len(s.array)))
+	}
+	s.own()
+	s.hash += (s.elements.mix(value) + s.elements.hash(s.array[pos:])*(hashBase-1)) * power(pos)
+	s.array = append(s.array, value)
+	copy(s.array[pos+1:], s.array[pos:])
+	s.array[pos] = value
+	s.aggregates = nil
+}
+
+func (s *SliceOf[T]) Delete(pos int) {
+	if pos >= len(s.array) {
+		panic(fmt.Errorf("could not delete element at position %d: the size is only %d", pos, len(s.array)))
+	}
+	s.own()
+	suffix := s.elements.hash(s.array[pos+1:])
+	s.hash += (suffix - suffix*hashBase - s.elements.mix(s.array[pos])) * power(pos)
+	s.array = append(s.array[:pos], s.array[pos+1:]...)
+	s.aggregates = nil
+}
+
+func (s *SliceOf[T]) Update(pos int, value T) {
+	if pos >= len(s.array) {
+		panic(fmt.Errorf("could not update element at position %d: the size is only %d", pos, len(s.array)))
+	}
+	s.own()
+	s.hash += (s.elements.mix(value) - s.elements.mix(s.array[pos])) * power(pos)
+	s.array[pos] = value
+	if s.aggregates != nil {
+		i := pos + len(s.array)
+		s.aggregates[i] = s.elements.added(AggregateOf[T]{}, value)
+		for i >>= 1; i > 0; i >>= 1 {
+			s.aggregates[i] = s.elements.combine(s.aggregates[2*i], s.aggregates[2*i+1])
+		}
+	}
+}
+
+func (s *SliceOf[T]) Size() int {
+	return len(s.array)
+}
+
+func (s *SliceOf[T]) Set(array []T) {
+	s.array = make([]T, len(array))
+	copy(s.array, array)
+	s.hash, s.shared = s.elements.hash(s.array), false
+	s.aggregates = nil
+}
+
+func (s *SliceOf[T]) GetAll() []T {
+	return s.Range(0, len(s.array))
+}
+
+func (s *SliceOf[T]) Range(from, to int) []T {
+	if from < 0 || to > len(s.array) || from > to {
+		panic(fmt.Errorf("could not get range [%d, %d): the size is only %d", from, to, len(s.array)))
+	}
+	array := make([]T, to-from)
+	copy(array, s.array[from:to])
+	return array
+}
+
+func (s *SliceOf[T]) InsertRange(pos int, values []T) {
+	if pos > len(s.array) {
+		panic(fmt.Errorf("could not insert elements at position %d: the size is only %d", pos, len(s.array)))
+	}
+	s.own()
+	suffix := s.elements.hash(s.array[pos:])
+	s.hash += (s.elements.hash(values) + suffix*power(len(values)) - suffix) * power(pos)
+	s.array = append(s.array, values...)
+	copy(s.array[pos+len(values):], s.array[pos:])
+	copy(s.array[pos:], values)
+	s.aggregates = nil
+}
+
+func (s *SliceOf[T]) DeleteRange(from, to int) {
+	if from < 0 || to > len(s.array) || from > to {
+		panic(fmt.Errorf("could not delete range [%d, %d): the size is only %d", from, to, len(s.array)))
+	}
+	s.own()
+	suffix := s.elements.hash(s.array[to:])
+	s.hash += (suffix - suffix*power(to-from) - s.elements.hash(s.array[from:to])) * power(from)
+	s.array = append(s.array[:from], s.array[to:]...)
+	s.aggregates = nil
+}
+
+func (s *SliceOf[T]) Iterate(from, to int, f func(pos int, value T) bool) {
+	for pos := from; pos < to; pos++ {
+		if !f(pos, s.array[pos]) {
+			return
+		}
+	}
+}
+
+// Aggregate summarizes the elements in [from, to) in O(log n), unless the segment tree has to be rebuilt after
+// an insertion or a deletion, that has taken linear time already
+func (s *SliceOf[T]) Aggregate(from, to int) AggregateOf[T] {
+	if from < 0 || to > len(s.array) || from > to {
+		panic(fmt.Errorf("could not aggregate range [%d, %d): the size is only %d", from, to, len(s.array)))
+	}
+	if s.aggregates == nil {
+		s.buildAggregates()
+	}
+	var result AggregateOf[T]
+	for from, to = from+len(s.array), to+len(s.array); from < to; from, to = from>>1, to>>1 {
+		if from&1 == 1 {
+			result = s.elements.combine(result, s.aggregates[from])
+			from++
+		}
+		if to&1 == 1 {
+			to--
+			result = s.elements.combine(result, s.aggregates[to])
+		}
+	}
+	return result
+}
+
+// buildAggregates builds the segment tree, whose leaves are the elements at [n, 2n) and every other node i
+// summarizes nodes 2i and 2i+1
+func (s *SliceOf[T]) buildAggregates() {
+	n := len(s.array)
+	s.aggregates = make([]AggregateOf[T], 2*n)
+	for i, value := range s.array {
+		s.aggregates[n+i] = s.elements.added(AggregateOf[T]{}, value)
+	}
+	for i := n - 1; i > 0; i-- {
+		s.aggregates[i] = s.elements.combine(s.aggregates[2*i], s.aggregates[2*i+1])
+	}
+}
+
+func (s *SliceOf[T]) Hash() uint64 {
+	return s.hash
+}
+
+func (s *SliceOf[T]) HashRange(from, to int) uint64 {
+	if from < 0 || to > len(s.array) || from > to {
+		panic(fmt.Errorf("could not hash range [%d, %d): the size is only %d", from, to, len(s.array)))
+	}
+	return s.elements.hash(s.array[from:to])
+}
+
+// Snapshot returns a copy in O(1), but the first modification of either of the two copies the whole slice then.
+// The segment tree is not shared: the snapshot builds its own one once it is queried.
+func (s *SliceOf[T]) Snapshot() SequenceOf[T] {
+	s.shared = true
+	return &SliceOf[T]{elements: s.elements, array: s.array, hash: s.hash, shared: true}
+}
+
+// Release does nothing: the slice shared with snapshots is garbage collected
+func (s *SliceOf[T]) Release() {
+}
+
+func (s *SliceOf[T]) Codec() Codec[T] {
+	return s.elements.codec
+}
+
+func (s *SliceOf[T]) own() {
+	if s.shared {
+		s.array = append(make([]T, 0, len(s.array)+1), s.array...)
+		s.shared = false
+	}
+}